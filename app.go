@@ -16,6 +16,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"syscall"
@@ -33,9 +34,17 @@ func (a *EventbridgeApp) Initialize() {
 	a.Live = false
 	a.Ready = false
 
+	// OS signals, see waitForShutdown
+	a.signalChan = make(chan os.Signal, 2)
+
 	// Override defaults
 	a.initializeEnvironment()
 
+	// Environment and customers for jobs
+	if err := appConfig.Reload(); err != nil {
+		log.Printf("Loading configuration failed: %v\n", err)
+	}
+
 	// Start the Dispatcher
 	a.Scheduler = &eventScheduler{}
 
@@ -90,10 +99,7 @@ func (a *EventbridgeApp) Run(addr string) {
 
 	a.Live = true
 
-	// Listen for SIGHUP
-	a.httpInterruptChan = make(chan os.Signal, 1)
-
-	<-a.httpInterruptChan
+	a.waitForShutdown()
 
 	// Create a deadline to wait for.
 	ctx, cancel := context.WithTimeout(context.Background(), httpconf.shutdownTimeout)
@@ -111,6 +117,53 @@ func (a *EventbridgeApp) Run(addr string) {
 	os.Exit(0)
 }
 
+// waitForShutdown handles OS signals until the dispatcher has shut down.
+// SIGTERM or SIGINT start a graceful shutdown, or wait for one the
+// management API started, and a second one escalates to a hard
+// shutdown. SIGHUP reloads the environment and customer configuration.
+// It also returns when the management API has completed a shutdown.
+func (a *EventbridgeApp) waitForShutdown() {
+	signal.Notify(a.signalChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer signal.Stop(a.signalChan)
+
+	signalled := false
+
+	for {
+		select {
+		case sig := <-a.signalChan:
+			if sig == syscall.SIGHUP {
+				a.reloadConfiguration()
+				continue
+			}
+
+			if signalled {
+				log.Printf("Received %v during shutdown, escalating to hard shutdown\n", sig)
+				a.Dispatcher.escalateShutdown()
+				continue
+			}
+
+			signalled = true
+			a.Ready = false
+			if a.Dispatcher.startShutdown(false) {
+				log.Printf("Received %v, starting graceful shutdown\n", sig)
+			} else {
+				log.Printf("Received %v, waiting for the shutdown in progress\n", sig)
+			}
+
+		case <-a.Dispatcher.shutdownFinished():
+			return
+		}
+	}
+}
+
+// reloadConfiguration rereads the environment and customer configuration
+func (a *EventbridgeApp) reloadConfiguration() {
+	log.Println("Received SIGHUP, reloading configuration")
+	if err := appConfig.Reload(); err != nil {
+		log.Printf("Reloading configuration failed, keeping previous: %v\n", err)
+	}
+}
+
 // Get for environment variable overrides
 func (a *EventbridgeApp) initializeEnvironment() {
 	var envVar = ""
@@ -169,7 +222,48 @@ func (a *EventbridgeApp) initializeEnvironment() {
 
 func (a *EventbridgeApp) initializeRoutes() {
 
+	// Dead letters and job types come first so {key} doesn't match them
 	uri := EventbridgeAPIVersion + "/" +
+		EventbridgeNamespaceID + "/" +
+		EventbridgeDefaultNamespace + "/" +
+		EventbridgeResourceType + "/" +
+		EventbridgeJobsEndPoint + "/" +
+		EventbridgeDeadLetterEndPoint
+	a.Router.HandleFunc(uri, a.listDeadLetters).Methods("GET")
+	log.Println("GET: ", uri)
+	a.Router.HandleFunc(uri, a.purgeDeadLetters).Methods("DELETE")
+	log.Println("DELETE: ", uri)
+
+	uri = EventbridgeAPIVersion + "/" +
+		EventbridgeNamespaceID + "/" +
+		EventbridgeDefaultNamespace + "/" +
+		EventbridgeResourceType + "/" +
+		EventbridgeJobsEndPoint + "/" +
+		EventbridgeDeadLetterEndPoint + EventbridgeKey
+	a.Router.HandleFunc(uri, a.getDeadLetter).Methods("GET")
+	log.Println("GET: ", uri)
+	a.Router.HandleFunc(uri, a.purgeDeadLetters).Methods("DELETE")
+	log.Println("DELETE: ", uri)
+
+	uri = EventbridgeAPIVersion + "/" +
+		EventbridgeNamespaceID + "/" +
+		EventbridgeDefaultNamespace + "/" +
+		EventbridgeResourceType + "/" +
+		EventbridgeJobsEndPoint + "/" +
+		EventbridgeDeadLetterEndPoint + EventbridgeKey + "/replay"
+	a.Router.HandleFunc(uri, a.replayDeadLetter).Methods("POST")
+	log.Println("POST: ", uri)
+
+	uri = EventbridgeAPIVersion + "/" +
+		EventbridgeNamespaceID + "/" +
+		EventbridgeDefaultNamespace + "/" +
+		EventbridgeResourceType + "/" +
+		EventbridgeJobsEndPoint + "/" +
+		EventbridgeJobTypesEndPoint
+	a.Router.HandleFunc(uri, a.listJobTypes).Methods("GET")
+	log.Println("GET: ", uri)
+
+	uri = EventbridgeAPIVersion + "/" +
 		EventbridgeNamespaceID + "/" +
 		EventbridgeDefaultNamespace + "/" +
 		EventbridgeResourceType + "/" +
@@ -193,6 +287,22 @@ func (a *EventbridgeApp) initializeRoutes() {
 	a.Router.HandleFunc(uri, a.getJob).Methods("GET")
 	log.Println("GET: ", uri)
 
+	uri = EventbridgeAPIVersion + "/" +
+		EventbridgeNamespaceID + "/" +
+		EventbridgeDefaultNamespace + "/" +
+		EventbridgeResourceType + "/" +
+		EventbridgeJobsEndPoint + EventbridgeKey + "/run"
+	a.Router.HandleFunc(uri, a.runJob).Methods("POST")
+	log.Println("POST: ", uri)
+
+	uri = EventbridgeAPIVersion + "/" +
+		EventbridgeNamespaceID + "/" +
+		EventbridgeDefaultNamespace + "/" +
+		EventbridgeResourceType + "/" +
+		EventbridgeJobsEndPoint + EventbridgeKey + "/runs/{run}"
+	a.Router.HandleFunc(uri, a.getJobRun).Methods("GET")
+	log.Println("GET: ", uri)
+
 	uri = EventbridgeAPIVersion + "/" +
 		EventbridgeNamespaceID + "/" +
 		EventbridgeDefaultNamespace + "/" +
@@ -201,6 +311,24 @@ func (a *EventbridgeApp) initializeRoutes() {
 	a.Router.HandleFunc(uri, a.getSchedule).Methods("GET")
 	log.Println("GET: ", uri)
 
+	uri = EventbridgeAPIVersion + "/" +
+		EventbridgeNamespaceID + "/" +
+		EventbridgeDefaultNamespace + "/" +
+		EventbridgeResourceType + "/" +
+		EventbridgeWorkflowsEndPoint
+	a.Router.HandleFunc(uri, a.listWorkflows).Methods("GET")
+	log.Println("GET: ", uri)
+	a.Router.HandleFunc(uri, a.createWorkflow).Methods("POST")
+	log.Println("POST: ", uri)
+
+	uri = EventbridgeAPIVersion + "/" +
+		EventbridgeNamespaceID + "/" +
+		EventbridgeDefaultNamespace + "/" +
+		EventbridgeResourceType + "/" +
+		EventbridgeWorkflowsEndPoint + EventbridgeKey
+	a.Router.HandleFunc(uri, a.getWorkflow).Methods("GET")
+	log.Println("GET: ", uri)
+
 	uri = EventbridgeAPIVersion + "/" +
 		EventbridgeNamespaceID + "/" +
 		EventbridgeDefaultNamespace + "/" +
@@ -341,12 +469,13 @@ func (a *EventbridgeApp) listSchedule(w http.ResponseWriter, r *http.Request) {
 
 // getJob swagger:route GET /api/v1/namespace/pavedroad/Eventbridge/jobs/{key} job getjob
 //
-// Returns a job given a key, where key is a UUID
+// Returns a job given a key, where key is a UUID, with its
+// latest executions and metrics
 //
 // Responses:
 //		default: genericError
 //				200: jobResponse
-//				200: listJobResponse
+//				200: jobDetailResponse
 //				404: get404Response
 //				500: genericError
 func (a *EventbridgeApp) getJob(w http.ResponseWriter, r *http.Request) {
@@ -368,6 +497,71 @@ func (a *EventbridgeApp) getJob(w http.ResponseWriter, r *http.Request) {
 	respondWithByte(w, status, jb)
 }
 
+// runJob swagger:route POST /api/v1/namespace/pavedroad/Eventbridge/jobs/{key}/run job runjob
+//
+// Sends the job given by key now instead of waiting for its next
+// run.  Params in the body override the job's for this run only.
+//
+// Responses:
+//		default: genericError
+//				202: runStatusResponse
+//				400: genericError
+//				404: get404Response
+//				503: genericError
+func (a *EventbridgeApp) runJob(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+
+	// Pre-processing hook
+	runJobPreHook(w, r, key)
+
+	payload, e := ioutil.ReadAll(r.Body)
+	if e != nil {
+		msg := fmt.Sprintf("{\"error\": \"ioutil.ReadAll failed\", \"Error\": \"%v\"}", e.Error())
+		respondWithByte(w, http.StatusBadRequest, []byte(msg))
+		return
+	}
+
+	status, jb, e := a.Scheduler.RunScheduleJob(key, payload)
+	if e != nil {
+		log.Printf("RunScheduleJob error: %v status %v", e.Error(), status)
+	}
+
+	// Post-processing hook
+	runJobPostHook(w, r, key)
+
+	respondWithByte(w, status, jb)
+}
+
+// getJobRun swagger:route GET /api/v1/namespace/pavedroad/Eventbridge/jobs/{key}/runs/{run} job getjobrun
+//
+// Returns the state of a run started by runJob, or any run
+// still in the job's history
+//
+// Responses:
+//		default: genericError
+//				200: runStatusResponse
+//				404: get404Response
+//				500: genericError
+func (a *EventbridgeApp) getJobRun(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+	run := vars["run"]
+
+	// Pre-processing hook
+	getJobRunPreHook(w, r, key, run)
+
+	status, jb, e := a.Scheduler.GetScheduleJobRun(key, run)
+	if e != nil {
+		log.Println(e)
+	}
+
+	// Post-processing hook
+	getJobRunPostHook(w, r, key, run)
+
+	respondWithByte(w, status, jb)
+}
+
 // getSchedule swagger:route GET /api/v1/namespace/pavedroad/Eventbridge/schedule/{key} schedule getschedule
 //
 // Returns a schedule given a key, where key is a UUID
@@ -498,11 +692,13 @@ func (a *EventbridgeApp) getManagement(w http.ResponseWriter, r *http.Request) {
 
 // putmanagement swagger:route GET /api/v1/namespace/pavedroad/Eventbridge/management management putmanagement
 //
-// Returns available management commands
+// Runs a management command, shutdowns reply 202 and run in the
+// background, poll them with shutdown_status
 //
 // Responses:
 //		default: genericError
 //				200: genericResponse
+//				202: genericResponse
 //				400: genericError
 //				500: genericError
 func (a *EventbridgeApp) putManagement(w http.ResponseWriter, r *http.Request) {
@@ -534,35 +730,20 @@ func (a *EventbridgeApp) putManagement(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Shutdown runs in the background, waitForShutdown stops the http
+	// server once it completes
+	if status == http.StatusAccepted &&
+		(requestedCommand.Command == "shutdown" ||
+			requestedCommand.Command == "shutdown_now") {
+		a.Ready = false
+	}
+
 	// Post-processing hook
 	putManagementPostHook(w, r)
 
 	// TODO: find a way to flush this out
 	respondWithByte(w, status, respBody)
 
-	// Special case for shutting down
-	if requestedCommand.Command == "shutdown" {
-		time.Sleep(time.Duration(a.Dispatcher.conf.gracefulShutdown) * time.Second)
-		e = syscall.Kill(syscall.Getpid(), syscall.SIGINT)
-		if e != nil {
-			msg := fmt.Sprintf("{\"error\": \"Shutting down with\", \"Error\": \"%v\"}", e.Error())
-			log.Println("shutdown error:", msg)
-		}
-
-	}
-
-	// Special case for hard kill
-	// We've sent the reply
-	if requestedCommand.Command == "shutdown_now" {
-		time.Sleep(time.Duration(a.Dispatcher.conf.hardShutdown) * time.Second)
-		e = syscall.Kill(syscall.Getpid(), syscall.SIGINT)
-		if e != nil {
-			msg := fmt.Sprintf("{\"error\": \"Shutting down with\", \"Error\": \"%v\"}", e.Error())
-			log.Println("shutdown_now error:", msg)
-		}
-
-	}
-
 	return
 }
 
@@ -663,6 +844,225 @@ func (a *EventbridgeApp) deleteJob(w http.ResponseWriter, r *http.Request) {
 	respondWithByte(w, status, respBody)
 }
 
+// listDeadLetters swagger:route GET /api/v1/namespace/pavedroad/Eventbridge/jobs/deadletters deadletters listdeadletters
+//
+// Returns jobs that failed all of their retries
+//
+// Responses:
+//		default: genericError
+//				200: genericResponse
+//				500: genericError
+func (a *EventbridgeApp) listDeadLetters(w http.ResponseWriter, r *http.Request) {
+
+	// Pre-processing hook
+	listDeadLettersPreHook(w, r)
+
+	status, respBody, e := a.Dispatcher.ListDeadLetters()
+	if e != nil {
+		log.Println(e)
+	}
+
+	// Post-processing hook
+	listDeadLettersPostHook(w, r)
+
+	respondWithByte(w, status, respBody)
+}
+
+// getDeadLetter swagger:route GET /api/v1/namespace/pavedroad/Eventbridge/jobs/deadletters/{key} deadletters getdeadletter
+//
+// Returns a dead letter given a key, where key is a UUID
+//
+// Responses:
+//		default: genericError
+//				200: genericResponse
+//				404: get404Response
+//				500: genericError
+func (a *EventbridgeApp) getDeadLetter(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+
+	// Pre-processing hook
+	getDeadLetterPreHook(w, r, key)
+
+	status, respBody, e := a.Dispatcher.GetDeadLetter(key)
+	if e != nil {
+		log.Println(e)
+	}
+
+	// Post-processing hook
+	getDeadLetterPostHook(w, r, key)
+
+	respondWithByte(w, status, respBody)
+}
+
+// replayDeadLetter swagger:route POST /api/v1/namespace/pavedroad/Eventbridge/jobs/deadletters/{key}/replay deadletters replaydeadletter
+//
+// Sends the job in a dead letter to the workers again and
+// removes the dead letter
+//
+// Responses:
+//		default: genericError
+//				200: genericResponse
+//				404: get404Response
+//				503: genericError
+func (a *EventbridgeApp) replayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+
+	// Pre-processing hook
+	replayDeadLetterPreHook(w, r, key)
+
+	status, respBody, e := a.Dispatcher.ReplayDeadLetter(key)
+	if e != nil {
+		log.Printf("ReplayDeadLetter error: %v status %v", e.Error(), status)
+	}
+
+	// Post-processing hook
+	replayDeadLetterPostHook(w, r, key)
+
+	respondWithByte(w, status, respBody)
+}
+
+// purgeDeadLetters swagger:route DELETE /api/v1/namespace/pavedroad/Eventbridge/jobs/deadletters/{key} deadletters purgedeadletters
+//
+// Deletes the dead letter specified by key, or all dead letters
+// if no key is given
+//
+// Responses:
+//		default: genericError
+//				200: genericResponse
+//				404: get404Response
+//				500: genericError
+func (a *EventbridgeApp) purgeDeadLetters(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+
+	// Pre-processing hook
+	purgeDeadLettersPreHook(w, r, key)
+
+	status, respBody, e := a.Dispatcher.PurgeDeadLetters(key)
+	if e != nil {
+		log.Printf("PurgeDeadLetters error: %v status %v", e.Error(), status)
+	}
+
+	// Post-processing hook
+	purgeDeadLettersPostHook(w, r, key)
+
+	respondWithByte(w, status, respBody)
+}
+
+// listJobTypes swagger:route GET /api/v1/namespace/pavedroad/Eventbridge/jobs/types EventbridgeJobsEndPoint listJobTypes
+//
+// Returns the job types that can be created and the schema
+// for each type's params
+//
+// Responses:
+//		default: genericError
+//				200: jobTypeResponse
+//				500: genericError
+func (a *EventbridgeApp) listJobTypes(w http.ResponseWriter, r *http.Request) {
+
+	// Pre-processing hook
+	listJobTypesPreHook(w, r)
+
+	jb, e := json.Marshal(jobTypes())
+	if e != nil {
+		msg := fmt.Sprintf("{\"error\": \"json.Marshal failed\", \"Error\": \"%v\"}", e.Error())
+		respondWithByte(w, http.StatusInternalServerError, []byte(msg))
+		return
+	}
+
+	// Post-processing hook
+	listJobTypesPostHook(w, r)
+
+	respondWithByte(w, http.StatusOK, jb)
+}
+
+// createWorkflow swagger:route POST /api/v1/namespace/pavedroad/Eventbridge/workflows workflows createWorkflow
+//
+// Creates a workflow, a DAG of jobs where each step runs when the
+// steps before it succeed or fail, and starts its first steps
+//
+// Responses:
+//		default: genericError
+//				201: workflowResponse
+//				400: genericError
+//				503: genericError
+func (a *EventbridgeApp) createWorkflow(w http.ResponseWriter, r *http.Request) {
+
+	// Pre-processing hook
+	createWorkflowPreHook(w, r)
+
+	payload, e := ioutil.ReadAll(r.Body)
+	if e != nil {
+		msg := fmt.Sprintf("{\"error\": \"ioutil.ReadAll failed\", \"Error\": \"%v\"}", e.Error())
+		respondWithByte(w, http.StatusBadRequest, []byte(msg))
+		return
+	}
+
+	status, respBody, e := a.Dispatcher.CreateWorkflow(payload)
+	if e != nil {
+		log.Printf("CreateWorkflow error: %v status %v", e.Error(), status)
+	}
+
+	// Post-processing hook
+	createWorkflowPostHook(w, r)
+
+	respondWithByte(w, status, respBody)
+}
+
+// listWorkflows swagger:route GET /api/v1/namespace/pavedroad/Eventbridge/workflows workflows listWorkflows
+//
+// Returns running and recently finished workflows
+//
+// Responses:
+//		default: genericError
+//				200: workflowResponse
+//				500: genericError
+func (a *EventbridgeApp) listWorkflows(w http.ResponseWriter, r *http.Request) {
+
+	// Pre-processing hook
+	listWorkflowsPreHook(w, r)
+
+	status, respBody, e := a.Dispatcher.ListWorkflows()
+	if e != nil {
+		log.Println(e)
+	}
+
+	// Post-processing hook
+	listWorkflowsPostHook(w, r)
+
+	respondWithByte(w, status, respBody)
+}
+
+// getWorkflow swagger:route GET /api/v1/namespace/pavedroad/Eventbridge/workflows/{key} workflows getWorkflow
+//
+// Returns the status of the workflow and each of its steps
+// given a key, where key is a UUID
+//
+// Responses:
+//		default: genericError
+//				200: workflowResponse
+//				404: get404Response
+//				500: genericError
+func (a *EventbridgeApp) getWorkflow(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+
+	// Pre-processing hook
+	getWorkflowPreHook(w, r, key)
+
+	status, respBody, e := a.Dispatcher.GetWorkflow(key)
+	if e != nil {
+		log.Println(e)
+	}
+
+	// Post-processing hook
+	getWorkflowPostHook(w, r, key)
+
+	respondWithByte(w, status, respBody)
+}
+
 // createSchedule swagger:route POST /api/v1/namespace/pavedroad/Eventbridge/EventbridgeSchedulerEndPoint EventbridgeSchedulerEndPoint createSchedule
 //
 // Create a new scheduler
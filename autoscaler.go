@@ -0,0 +1,309 @@
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root
+// for full license information.
+//
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Defaults for the autoscaler
+const (
+	// MinNumberOfWorkers the autoscaler will shrink to
+	MinNumberOfWorkers int = 1
+
+	// MaxNumberOfWorkers the autoscaler will grow to
+	MaxNumberOfWorkers int = 20
+
+	// AutoscaleBacklogHigh percentage of the worker job channel in use
+	// before adding a worker
+	AutoscaleBacklogHigh int = 80
+
+	// AutoscaleBacklogLow percentage of the worker job channel in use
+	// before removing a worker
+	AutoscaleBacklogLow int = 10
+
+	// AutoscaleLatencyHigh average job latency in milliseconds before
+	// adding a worker, 0 disables the latency check
+	AutoscaleLatencyHigh int = 0
+
+	// AutoscaleCooldown seconds to wait between scaling decisions
+	AutoscaleCooldown int = 60
+
+	// autoscaleInterval seconds between backlog samples
+	autoscaleInterval int = 5
+
+	// maxScalingDecisions kept in dispatcher metrics
+	maxScalingDecisions int = 20
+)
+
+// Management API
+const (
+	autoscaleEnabled         string = "autoscale_enabled"
+	minNumberOfWorkers       string = "min_number_of_workers"
+	maxNumberOfWorkers       string = "max_number_of_workers"
+	autoscaleBacklogHigh     string = "autoscale_backlog_high_percent"
+	autoscaleBacklogLow      string = "autoscale_backlog_low_percent"
+	autoscaleLatencyHigh     string = "autoscale_latency_high_ms"
+	autoscaleCooldownSeconds string = "autoscale_cooldown_seconds"
+)
+
+// Metrics constants
+const (
+	dispatcherScaleUps         = "autoscale_ups"
+	dispatcherScaleDowns       = "autoscale_downs"
+	dispatcherAverageLatencyMS = "average_job_latency_ms"
+)
+
+// scalingDecision records why the pool changed size
+type scalingDecision struct {
+	Time             time.Time `json:"time"`
+	From             int       `json:"from"`
+	To               int       `json:"to"`
+	Reason           string    `json:"reason"`
+	BacklogPercent   int       `json:"backlog_percent"`
+	AverageLatencyMS int       `json:"average_latency_ms"`
+}
+
+// autoscalerConfiguration options settable through /management
+type autoscalerConfiguration struct {
+	enabled            bool
+	minNumberOfWorkers int
+	maxNumberOfWorkers int
+	backlogHigh        int // percent
+	backlogLow         int // percent
+	latencyHigh        int // milliseconds
+	cooldown           int // seconds
+}
+
+// autoscaler resizes the dispatchers worker pool based on
+// the worker job channel backlog and job latency
+type autoscaler struct {
+	d          *dispatcher
+	conf       autoscalerConfiguration
+	lastScale  time.Time
+	avgLatency time.Duration // exponentially weighted
+	mux        *sync.Mutex
+}
+
+// Init sets defaults, the autoscaler starts disabled
+func (as *autoscaler) Init(d *dispatcher) {
+	as.d = d
+	as.mux = &sync.Mutex{}
+	as.conf = autoscalerConfiguration{
+		enabled:            false,
+		minNumberOfWorkers: MinNumberOfWorkers,
+		maxNumberOfWorkers: MaxNumberOfWorkers,
+		backlogHigh:        AutoscaleBacklogHigh,
+		backlogLow:         AutoscaleBacklogLow,
+		latencyHigh:        AutoscaleLatencyHigh,
+		cooldown:           AutoscaleCooldown,
+	}
+}
+
+// Fields returns the management fields the autoscaler handles
+func (as *autoscaler) Fields() []string {
+	return []string{
+		autoscaleEnabled,
+		minNumberOfWorkers,
+		maxNumberOfWorkers,
+		autoscaleBacklogHigh,
+		autoscaleBacklogLow,
+		autoscaleLatencyHigh,
+		autoscaleCooldownSeconds}
+}
+
+// ObserveLatency folds a completed jobs run time into the average
+func (as *autoscaler) ObserveLatency(elapsed time.Duration) {
+	as.mux.Lock()
+	if as.avgLatency == 0 {
+		as.avgLatency = elapsed
+	} else {
+		as.avgLatency = (as.avgLatency*7 + elapsed) / 8
+	}
+	avg := as.avgLatency
+	as.mux.Unlock()
+
+	as.d.MetricSet(dispatcherAverageLatencyMS, int(avg.Milliseconds()))
+}
+
+// Run samples the backlog every autoscaleInterval seconds
+func (as *autoscaler) Run() {
+	ticker := time.NewTicker(time.Duration(autoscaleInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			as.evaluate()
+		case <-as.d.ctx.Done():
+			return
+		}
+	}
+}
+
+// evaluate makes at most one scaling decision
+func (as *autoscaler) evaluate() {
+	as.mux.Lock()
+	conf := as.conf
+	lastScale := as.lastScale
+	avgMS := int(as.avgLatency.Milliseconds())
+	as.mux.Unlock()
+
+	if !conf.enabled {
+		return
+	}
+
+	if time.Since(lastScale) < time.Duration(conf.cooldown)*time.Second {
+		return
+	}
+
+	backlog := 0
+	if c := cap(as.d.workerJobChan); c > 0 {
+		backlog = len(as.d.workerJobChan) * 100 / c
+	}
+
+	as.d.mux.Lock()
+	from := as.d.conf.numberOfWorkers
+	active := as.d.workersActive
+	as.d.mux.Unlock()
+
+	if !active {
+		return
+	}
+
+	to := from
+	var reason string
+	latencyHigh := conf.latencyHigh > 0 && avgMS >= conf.latencyHigh
+
+	switch {
+	case from < conf.minNumberOfWorkers:
+		to = conf.minNumberOfWorkers
+		reason = "below minimum workers"
+	case from > conf.maxNumberOfWorkers:
+		to = conf.maxNumberOfWorkers
+		reason = "above maximum workers"
+	case backlog >= conf.backlogHigh && from < conf.maxNumberOfWorkers:
+		to = from + 1
+		reason = fmt.Sprintf("backlog %d%% >= %d%%", backlog, conf.backlogHigh)
+	case latencyHigh && from < conf.maxNumberOfWorkers:
+		to = from + 1
+		reason = fmt.Sprintf("latency %dms >= %dms", avgMS, conf.latencyHigh)
+	case backlog <= conf.backlogLow && !latencyHigh && from > conf.minNumberOfWorkers:
+		to = from - 1
+		reason = fmt.Sprintf("backlog %d%% <= %d%%", backlog, conf.backlogLow)
+	}
+
+	if to == from {
+		return
+	}
+
+	as.d.mux.Lock()
+	as.d.conf.numberOfWorkers = to
+	as.d.mux.Unlock()
+	as.d.MetricSet(dispatcherTargetWorkers, to)
+
+	if e := as.d.resizeWorkerPool(); e != nil {
+		log.Printf("Autoscale from %d to %d failed: %v\n", from, to, e)
+		return
+	}
+
+	as.mux.Lock()
+	as.lastScale = time.Now()
+	as.mux.Unlock()
+
+	if to > from {
+		as.d.MetricInc(dispatcherScaleUps)
+	} else {
+		as.d.MetricInc(dispatcherScaleDowns)
+	}
+
+	as.d.MetricAddScalingDecision(scalingDecision{
+		Time:             time.Now(),
+		From:             from,
+		To:               to,
+		Reason:           reason,
+		BacklogPercent:   backlog,
+		AverageLatencyMS: avgMS,
+	})
+	log.Printf("Autoscaled workers from %d to %d: %s\n", from, to, reason)
+}
+
+// SetConfigVariable changes the value of an autoscaler field
+func (as *autoscaler) SetConfigVariable(name string, value int) (msg []byte, err error) {
+	var rmsg string
+	var old int
+
+	if value < 0 {
+		rmsg = fmt.Sprintf("{\"Status\": \"%s must not be negative\"}", name)
+		return []byte(rmsg), errors.New("negative value")
+	}
+
+	as.mux.Lock()
+	defer as.mux.Unlock()
+
+	switch name {
+	case autoscaleEnabled:
+		if as.conf.enabled {
+			old = 1
+		}
+		as.conf.enabled = value != 0
+
+	case minNumberOfWorkers:
+		if value < 1 || value > as.conf.maxNumberOfWorkers {
+			rmsg = fmt.Sprintf("{\"Status\": \"%s must be between 1 and %d\"}",
+				name, as.conf.maxNumberOfWorkers)
+			return []byte(rmsg), errors.New("invalid minimum workers")
+		}
+		old = as.conf.minNumberOfWorkers
+		as.conf.minNumberOfWorkers = value
+
+	case maxNumberOfWorkers:
+		if value < as.conf.minNumberOfWorkers {
+			rmsg = fmt.Sprintf("{\"Status\": \"%s must be at least %d\"}",
+				name, as.conf.minNumberOfWorkers)
+			return []byte(rmsg), errors.New("invalid maximum workers")
+		}
+		old = as.conf.maxNumberOfWorkers
+		as.conf.maxNumberOfWorkers = value
+
+	case autoscaleBacklogHigh:
+		if value > 100 || value <= as.conf.backlogLow {
+			rmsg = fmt.Sprintf("{\"Status\": \"%s must be between %d and 100\"}",
+				name, as.conf.backlogLow+1)
+			return []byte(rmsg), errors.New("invalid backlog threshold")
+		}
+		old = as.conf.backlogHigh
+		as.conf.backlogHigh = value
+
+	case autoscaleBacklogLow:
+		if value >= as.conf.backlogHigh {
+			rmsg = fmt.Sprintf("{\"Status\": \"%s must be less than %d\"}",
+				name, as.conf.backlogHigh)
+			return []byte(rmsg), errors.New("invalid backlog threshold")
+		}
+		old = as.conf.backlogLow
+		as.conf.backlogLow = value
+
+	case autoscaleLatencyHigh:
+		old = as.conf.latencyHigh
+		as.conf.latencyHigh = value
+
+	case autoscaleCooldownSeconds:
+		old = as.conf.cooldown
+		as.conf.cooldown = value
+
+	default:
+		rmsg = fmt.Sprintf("{\"Status\": \"%s unknown\"}", name)
+		return []byte(rmsg), errors.New("unknown set field")
+	}
+
+	rmsg = fmt.Sprintf("{\"Status\": \"%s changed from %d to %d\"}",
+		name, old, value)
+	return []byte(rmsg), nil
+}
@@ -0,0 +1,99 @@
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root
+// for full license information.
+//
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pavedroad-io/eventbridge/s3"
+)
+
+const (
+	// customerFile is read when the environment loads from disk
+	customerFile string = "customer.yaml"
+
+	// loadFromDisk LoadFrom value for reading customers from customerFile
+	loadFromDisk string = "disk"
+)
+
+// appConfiguration caches the environment and, when loading from disk,
+// the customer list.  Both are reloaded when the process receives a
+// SIGHUP.  Customers loaded from the network are fetched on every call
+// since the network service is the source of truth.
+type appConfiguration struct {
+	mux       *sync.Mutex
+	loaded    bool
+	loadedAt  time.Time
+	env       Environment
+	customers []s3.Customer
+}
+
+// appConfig is shared by the application and its jobs
+var appConfig = appConfiguration{mux: &sync.Mutex{}}
+
+// Reload reads the environment and customer configuration
+// On error the previous configuration is kept
+func (c *appConfiguration) Reload() error {
+	var env Environment
+	if err := env.load(); err != nil {
+		return err
+	}
+
+	var customers []s3.Customer
+	if env.LoadFrom == loadFromDisk {
+		cust := s3.Customer{}
+		cl, err := cust.LoadFromDisk(customerFile)
+		if err != nil {
+			return err
+		}
+		customers = cl
+	}
+
+	c.mux.Lock()
+	c.env = env
+	c.customers = customers
+	c.loaded = true
+	c.loadedAt = time.Now()
+	c.mux.Unlock()
+
+	log.Printf("Configuration loaded for environment %v from %v\n",
+		env.EnvironmentName, env.LoadFrom)
+	return nil
+}
+
+// Environment returns the cached environment, loading it on first use
+func (c *appConfiguration) Environment() Environment {
+	c.mux.Lock()
+	loaded := c.loaded
+	c.mux.Unlock()
+
+	if !loaded {
+		if err := c.Reload(); err != nil {
+			log.Printf("Loading configuration failed: %v\n", err)
+		}
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.env
+}
+
+// Customers returns the customers to process
+func (c *appConfiguration) Customers() ([]s3.Customer, error) {
+	env := c.Environment()
+
+	if env.LoadFrom == loadFromDisk {
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		customers := make([]s3.Customer, len(c.customers))
+		copy(customers, c.customers)
+		return customers, nil
+	}
+
+	cust := s3.Customer{}
+	return cust.LoadFromNetwork(env.EventBridgeConfigURL)
+}
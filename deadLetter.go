@@ -0,0 +1,335 @@
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root
+// for full license information.
+//
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pavedroad-io/eventbridge/s3"
+)
+
+// DeadLetterDir default directory for the disk dead-letter store
+// override it with EB_DEAD_LETTER_DIR
+const DeadLetterDir string = "deadletters"
+
+// Metrics constants
+const (
+	dispatcherDeadLettered      = "jobs_dead_lettered"
+	dispatcherDeadLetterReplays = "dead_letters_replayed"
+)
+
+// replayTimeout seconds to wait for room on the job channel
+const replayTimeout = 5
+
+var errDeadLetterNotFound = errors.New("dead letter not found")
+
+// deadLetter is a job that failed all of its attempts
+type deadLetter struct {
+	ID       string           `json:"id"`
+	JobID    string           `json:"job_id"`
+	JobType  string           `json:"job_type"`
+	Attempts int              `json:"attempts"`
+	Error    string           `json:"error"`
+	LogItem  *s3.LogQueueItem `json:"log_item,omitempty"`
+	Job      json.RawMessage  `json:"job"`
+	Created  time.Time        `json:"created"`
+}
+
+// deadLetterStore persists dead letters, implement it to store
+// them somewhere other than local disk
+type deadLetterStore interface {
+	Put(dl deadLetter) error
+	Get(id string) (deadLetter, error)
+	List() ([]deadLetter, error)
+	Delete(id string) error
+	Purge() (int, error)
+}
+
+// diskDeadLetterStore writes one JSON file per dead letter
+type diskDeadLetterStore struct {
+	dir string
+	mux *sync.Mutex
+}
+
+// newDiskDeadLetterStore returns a store using dir
+func newDiskDeadLetterStore(dir string) *diskDeadLetterStore {
+	return &diskDeadLetterStore{dir: dir, mux: &sync.Mutex{}}
+}
+
+// path returns the file for id, ids must be UUIDs so they
+// can't name files outside of the store
+func (ds *diskDeadLetterStore) path(id string) (string, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return "", errDeadLetterNotFound
+	}
+	return filepath.Join(ds.dir, id+".json"), nil
+}
+
+// Put writes dl, replacing any entry with the same ID
+func (ds *diskDeadLetterStore) Put(dl deadLetter) error {
+	fn, err := ds.path(dl.ID)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(dl, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
+
+	if err := os.MkdirAll(ds.dir, 0755); err != nil {
+		return err
+	}
+
+	// Write then rename so readers never see a partial entry
+	tmp := fn + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+// Get reads the entry with id
+func (ds *diskDeadLetterStore) Get(id string) (deadLetter, error) {
+	dl := deadLetter{}
+
+	fn, err := ds.path(id)
+	if err != nil {
+		return dl, err
+	}
+
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
+
+	data, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return dl, errDeadLetterNotFound
+	} else if err != nil {
+		return dl, err
+	}
+
+	err = json.Unmarshal(data, &dl)
+	return dl, err
+}
+
+// List returns every entry oldest first
+func (ds *diskDeadLetterStore) List() ([]deadLetter, error) {
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
+
+	files, err := ioutil.ReadDir(ds.dir)
+	if os.IsNotExist(err) {
+		return []deadLetter{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	list := []deadLetter{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(ds.dir, f.Name()))
+		if err != nil {
+			log.Printf("Reading dead letter %s failed: %v\n", f.Name(), err)
+			continue
+		}
+
+		dl := deadLetter{}
+		if err := json.Unmarshal(data, &dl); err != nil {
+			log.Printf("Decoding dead letter %s failed: %v\n", f.Name(), err)
+			continue
+		}
+		list = append(list, dl)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list, nil
+}
+
+// Delete removes the entry with id
+func (ds *diskDeadLetterStore) Delete(id string) error {
+	fn, err := ds.path(id)
+	if err != nil {
+		return err
+	}
+
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
+
+	err = os.Remove(fn)
+	if os.IsNotExist(err) {
+		return errDeadLetterNotFound
+	}
+	return err
+}
+
+// Purge removes every entry returning how many were removed
+func (ds *diskDeadLetterStore) Purge() (int, error) {
+	list, err := ds.List()
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, dl := range list {
+		if err := ds.Delete(dl.ID); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// deadLetter stores a job that failed its last attempt
+func (d *dispatcher) deadLetter(j Job, r Result, cause error, attempts int) {
+	dl := deadLetter{
+		ID:       uuid.New().String(),
+		JobID:    j.ID(),
+		JobType:  j.Type(),
+		Attempts: attempts,
+		Error:    cause.Error(),
+		Job:      r.Job(),
+		Created:  time.Now(),
+	}
+
+	// The last error LogErrorResults recorded
+	if msg, ok := r.MetaData()["original_error"]; ok {
+		dl.Error = msg
+	}
+
+	if lp, ok := j.(*logProcessorJob); ok {
+		item := lp.Log
+		dl.LogItem = &item
+	}
+
+	if err := d.deadLetters.Put(dl); err != nil {
+		log.Printf("Dead letter for job %v failed: %v\n", j.ID(), err)
+		return
+	}
+
+	d.MetricInc(dispatcherDeadLettered)
+	log.Printf("Job: %v dead lettered as %v\n", j.ID(), dl.ID)
+}
+
+// ListDeadLetters returns every dead letter
+func (d *dispatcher) ListDeadLetters() (httpStatusCode int, jsonb []byte, err error) {
+	list, e := d.deadLetters.List()
+	if e != nil {
+		msg := fmt.Sprintf("{\"error\": \"listing dead letters failed\", \"Error\": \"%v\"}", e)
+		return http.StatusInternalServerError, []byte(msg), e
+	}
+
+	return deadLetterJSON(http.StatusOK, list)
+}
+
+// GetDeadLetter returns the dead letter with id
+func (d *dispatcher) GetDeadLetter(id string) (httpStatusCode int, jsonb []byte, err error) {
+	dl, e := d.deadLetters.Get(id)
+	if e != nil {
+		return deadLetterError(id, e)
+	}
+
+	return deadLetterJSON(http.StatusOK, dl)
+}
+
+// ReplayDeadLetter sends the job in the dead letter with id to
+// the workers again as a new job, the entry is removed once queued
+func (d *dispatcher) ReplayDeadLetter(id string) (httpStatusCode int, jsonb []byte, err error) {
+	dl, e := d.deadLetters.Get(id)
+	if e != nil {
+		return deadLetterError(id, e)
+	}
+
+	lr := &logResult{job: dl.Job, jobType: dl.JobType}
+	j, e := lr.Decode()
+	if e != nil {
+		msg := fmt.Sprintf("{\"error\": \"decoding job failed\", \"Error\": \"%v\"}", e)
+		return http.StatusUnprocessableEntity, []byte(msg), e
+	}
+
+	if e := j.InitWithJobChan(d.jobChannel()); e != nil {
+		msg := fmt.Sprintf("{\"error\": \"job init failed\", \"Error\": \"%v\"}", e)
+		return http.StatusInternalServerError, []byte(msg), e
+	}
+
+	select {
+	case d.jobChannel() <- j:
+	case <-d.ctx.Done():
+		msg := fmt.Sprintf("{\"error\": \"dispatcher is shut down\"}")
+		return http.StatusServiceUnavailable, []byte(msg), errors.New("dispatcher is shut down")
+	case <-time.After(replayTimeout * time.Second):
+		msg := fmt.Sprintf("{\"error\": \"job queue is full\"}")
+		return http.StatusServiceUnavailable, []byte(msg), errors.New("job queue is full")
+	}
+
+	if e := d.deadLetters.Delete(id); e != nil {
+		log.Printf("Removing replayed dead letter %v failed: %v\n", id, e)
+	}
+	d.MetricInc(dispatcherDeadLetterReplays)
+
+	msg := fmt.Sprintf("{\"Status\": \"Dead letter %v replayed as job %v\"}", id, j.ID())
+	return http.StatusOK, []byte(msg), nil
+}
+
+// PurgeDeadLetters removes the dead letter with id, or all of them
+// if id is empty
+func (d *dispatcher) PurgeDeadLetters(id string) (httpStatusCode int, jsonb []byte, err error) {
+	if id != "" {
+		if e := d.deadLetters.Delete(id); e != nil {
+			return deadLetterError(id, e)
+		}
+		msg := fmt.Sprintf("{\"Status\": \"Dead letter %v purged\"}", id)
+		return http.StatusOK, []byte(msg), nil
+	}
+
+	n, e := d.deadLetters.Purge()
+	if e != nil {
+		msg := fmt.Sprintf("{\"error\": \"purge failed\", \"Error\": \"%v\"}", e)
+		return http.StatusInternalServerError, []byte(msg), e
+	}
+
+	msg := fmt.Sprintf("{\"Status\": \"%d dead letters purged\"}", n)
+	return http.StatusOK, []byte(msg), nil
+}
+
+// deadLetterJSON marshals v as the response body
+func deadLetterJSON(status int, v interface{}) (httpStatusCode int, jsonb []byte, err error) {
+	jb, e := json.Marshal(v)
+	if e != nil {
+		msg := fmt.Sprintf("{\"error\": \"json.Marshal failed\", \"Error\": \"%v\"}", e)
+		return http.StatusInternalServerError, []byte(msg), e
+	}
+	return status, jb, nil
+}
+
+// deadLetterError maps store errors to a response
+func deadLetterError(id string, e error) (httpStatusCode int, jsonb []byte, err error) {
+	if e == errDeadLetterNotFound {
+		msg := fmt.Sprintf("{\"error\": \"Not found\", \"UUID\": \"%v\"}", id)
+		return http.StatusNotFound, []byte(msg), nil
+	}
+
+	msg := fmt.Sprintf("{\"error\": \"dead letter store failed\", \"Error\": \"%v\"}", e)
+	return http.StatusInternalServerError, []byte(msg), e
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,7 +9,6 @@ import (
 	"net/http"
 	"os"
 	"sync"
-	"syscall"
 	"time"
 )
 
@@ -16,6 +16,12 @@ import (
 const (
 	dispatcherJobsSent        = "jobs_sent"
 	dispatcherResultsReceived = "results_received"
+	dispatcherCurrentWorkers  = "current_number_of_workers"
+	dispatcherTargetWorkers   = "target_number_of_workers"
+	dispatcherWorkersStarted  = "workers_started"
+	dispatcherWorkersRetired  = "workers_retired"
+	dispatcherJobsInFlight    = "jobs_in_flight"
+	dispatcherShutdowns       = "shutdowns"
 )
 
 // Defaults for dispatcher and workers
@@ -74,6 +80,33 @@ type listJobsResponse struct {
 
 	//Type: of job the represents
 	Type string `json:"type"`
+
+	// Params for the job type, checked against its schema
+	Params json.RawMessage `json:"params,omitempty"`
+
+	// Optional schedule for this job
+	jobSchedule
+
+	// NextRunTime the job will be sent, not set if disabled
+	NextRunTime *time.Time `json:"next_run_time,omitempty"`
+
+	// Running is the number of runs in progress
+	Running int `json:"running"`
+
+	// SkippedRuns by the forbid concurrency policy
+	SkippedRuns int `json:"skipped_runs"`
+}
+
+// jobDetailResponse is a job with its recent executions
+//
+// swagger:response jobDetailResponse
+type jobDetailResponse struct {
+	// in: body
+	listJobsResponse
+
+	// History of the latest executions oldest first, and
+	// Metrics from the latest one
+	History jobRecord `json:"history"`
 }
 
 // get404Response Not found
@@ -157,17 +190,26 @@ type managementRequest struct {
 
 	// Value for field
 	Value int `json:"field_value"`
+
+	// JobID for cancel_job
+	JobID string `json:"job_id"`
 }
 
 // worker is a go worker pool pattern
 type worker struct {
+	id           int
+	d            *dispatcher // pool this worker belongs to
 	currentJob   Job
+	holdsSlot    bool // currentJob's tenant slot is not released yet
 	lastJob      Job
 	wg           *sync.WaitGroup
 	jobChan      chan Job
 	responseChan chan Result
 	interrupt    chan os.Signal
-	done         chan bool
+
+	// done is owned by this worker, closing it retires
+	// the worker once its current job finishes
+	done chan bool
 }
 
 // Run starts listing for jobs to be processed
@@ -175,31 +217,95 @@ type worker struct {
 // Read the done channel to see if this worker should exit
 // Read the interrupt channel to see if this worker must exit
 func (w *worker) Run() error {
-
 	for {
+		// A pending stop wins over new work so a retiring
+		// worker never picks up another job
+		select {
+		case <-w.done:
+			return nil
+		default:
+		}
+
 		select {
 		case currentJob := <-w.jobChan:
-			r, e := currentJob.Run()
+			w.currentJob = currentJob
+			w.holdsSlot = true
+			w.d.jobStarted()
+			start := time.Now()
+			ctx, done := w.d.timeouts.Context(currentJob)
+			r, e := w.runJob(withSubmitter(ctx, w.d, currentJob), currentJob)
+			w.d.autoscaler.ObserveLatency(time.Since(start))
+			w.d.timeouts.runEnded(currentJob, ctx)
+			ctxErr := ctx.Err()
+			done()
+			w.releaseSlot()
 
 			if e != nil {
 				log.Printf("Job: %v error: %v\n", currentJob.ID(), e.Error())
 			}
-			w.responseChan <- r
-			w.lastJob = currentJob
 
-		case done := <-w.done:
-			if done {
-				w.wg.Done()
-				return nil
+			// Failed jobs are retried after a backoff, only the
+			// final attempt's result is forwarded.  Cancelled jobs
+			// and errors that can't be fixed by running again are
+			// not retried, jobs that timed out are
+			attempt, max := w.d.retrier.Attempt(currentJob)
+			cause := jobFailed(currentJob, r, e)
+			if cause == nil && ctxErr != nil {
+				cause = ctxErr
 			}
+			canRetry := cause != nil && jobRetryable(currentJob, r, cause)
+			if canRetry && attempt < max && ctxErr != context.Canceled {
+				w.d.families.retrying(currentJob)
+				w.d.retrier.Retry(currentJob, attempt, cause)
+			} else {
+				if cause != nil && max > 1 {
+					if canRetry {
+						w.d.MetricInc(dispatcherRetryExhausted)
+					} else {
+						w.d.MetricInc(dispatcherNotRetryable)
+					}
+				}
+				w.d.retrier.Done(currentJob)
+				w.d.acknowledge(currentJob)
+
+				if r == nil {
+					if cause == nil {
+						cause = errors.New("job returned no result")
+					}
+					r, _ = (&logResult{}).LogErrorResults(currentJob, cause)
+				}
+				attemptMetaData(r, attempt, max)
+
+				// Jobs that exhausted their retries are kept for replay
+				if cause != nil && max > 1 {
+					w.d.deadLetter(currentJob, r, cause, attempt)
+				}
+
+				// A parent's result waits for its children
+				for _, o := range w.d.families.finish(currentJob, r, cause != nil) {
+					w.d.workflows.finished(o)
+					w.responseChan <- o.result
+				}
+			}
+			w.lastJob = currentJob
+			w.currentJob = nil
+			w.d.jobFinished()
+
+		case <-w.done:
+			return nil
 
 		case <-w.interrupt:
-			w.wg.Done()
 			return nil
 		}
 	}
 }
 
+// exit releases the wait group and notifies the pool
+func (w *worker) exit() {
+	w.wg.Done()
+	w.d.workerRetired(w)
+}
+
 // dispatcherConfiguration options set during Initialize
 type dispatcherConfiguration struct {
 	scheduler              Scheduler
@@ -210,6 +316,8 @@ type dispatcherConfiguration struct {
 	sizeOfResultChannel int
 	gracefulShutdown    int
 	hardShutdown        int
+	deadLetters         deadLetterStore // defaults to local disk
+	jobStore            jobStore        // nil unless EB_JOB_QUEUE_DIR is set
 }
 
 // SetSane Verify and set sane configuration options
@@ -240,6 +348,27 @@ func (dc *dispatcherConfiguration) SetSane(d *dispatcher) {
 	if d.conf.hardShutdown == 0 {
 		d.conf.hardShutdown = HardShutdown
 	}
+
+	if d.conf.deadLetters == nil {
+		dir := DeadLetterDir
+		if v := os.Getenv("EB_DEAD_LETTER_DIR"); v != "" {
+			dir = v
+		}
+		d.conf.deadLetters = newDiskDeadLetterStore(dir)
+	}
+	d.deadLetters = d.conf.deadLetters
+
+	if d.conf.jobStore == nil {
+		if dir := os.Getenv("EB_JOB_QUEUE_DIR"); dir != "" {
+			ws, err := newWALJobStore(dir)
+			if err != nil {
+				log.Printf("Job queue %s not opened, jobs won't survive a restart: %v\n", dir, err)
+			} else {
+				d.conf.jobStore = ws
+			}
+		}
+	}
+	d.jobStore = d.conf.jobStore
 }
 
 // dispatcher structure
@@ -253,17 +382,54 @@ type dispatcher struct {
 	schedulerResultChan chan Result    // Channel to write result to
 	schedulerDone       chan bool      // Shutdown initiated by applicatoin
 	schedulerInterrupt  chan os.Signal // Shutdown initiated by OS
+	jobChanSwapped      chan bool      // Wakes Forwarder after a resize
 
 	// Workers config
-	wg      *sync.WaitGroup
-	workers []*worker
+	wg            *sync.WaitGroup
+	workers       []*worker // active workers, excludes retiring ones
+	nextWorkerID  int
+	workersActive bool // false after stop_workers
+	inFlight      int  // jobs being run by a worker
+
+	// Lifecycle, ctx is cancelled once shutdown completes
+	ctx           context.Context
+	cancel        context.CancelFunc
+	stopForward   chan bool // closed to stop the Forwarder
+	shutdownOnce  *sync.Once
+	interruptOnce *sync.Once
+
+	// Shutdown progress, see startShutdown
+	shuttingDown     bool
+	shutdownCancel   context.CancelFunc // escalates a running shutdown
+	shutdownDone     chan bool          // closed once Shutdown returns
+	shutdownSummary  shutdownSummary
+	shutdownEscalate bool
 
 	// Worker Channels
 	workerJobChan     chan Job
 	workerJobResponse chan Result
-	workerDone        chan bool
 	workerInterrupt   chan os.Signal
 
+	// Grows or shrinks the pool based on backlog
+	autoscaler autoscaler
+	retrier    retrier
+	timeouts   jobTimeouts
+
+	// Jobs waiting for a worker by priority class
+	queues priorityQueues
+
+	// Jobs that ran out of retries
+	deadLetters deadLetterStore
+
+	// Queued jobs kept across restarts, nil when not enabled
+	jobStore jobStore
+
+	// Parents waiting for the children they submitted
+	families jobFamilies
+
+	// Jobs chained into DAGs
+	workflows workflows
+
 	// Management response
 	managementOptions managementGetResponse
 
@@ -274,10 +440,12 @@ type dispatcher struct {
 }
 
 type dispatcherMetrics struct {
-	StartTime time.Time      `json:"start_time"`
-	UpTime    time.Duration  `json:"up_time"`
-	Counters  map[string]int `json:"counters"`
-	mux       *sync.Mutex
+	StartTime        time.Time         `json:"start_time"`
+	UpTime           time.Duration     `json:"up_time"`
+	Counters         map[string]int    `json:"counters"`
+	ScalingDecisions []scalingDecision `json:"scaling_decisions"`
+	TenantsInFlight  map[string]int    `json:"tenants_in_flight"`
+	mux              *sync.Mutex
 }
 
 func (d *dispatcher) MetricToJSON() ([]byte, error) {
@@ -313,6 +481,12 @@ func (d *dispatcher) MetricInc(key string) {
 	d.metrics.mux.Unlock()
 }
 
+func (d *dispatcher) MetricDec(key string) {
+	d.metrics.mux.Lock()
+	d.metrics.Counters[key]--
+	d.metrics.mux.Unlock()
+}
+
 func (d *dispatcher) MetricSet(key string, value int) {
 	d.metrics.mux.Lock()
 	d.metrics.Counters[key] = value
@@ -325,6 +499,32 @@ func (d *dispatcher) MetricValue(key string) int {
 	return d.metrics.Counters[key]
 }
 
+// MetricSetTenantInFlight records jobs in flight for tenant, tenants
+// with none are removed
+func (d *dispatcher) MetricSetTenantInFlight(tenant string, n int) {
+	if tenant == "" {
+		return
+	}
+
+	d.metrics.mux.Lock()
+	if n > 0 {
+		d.metrics.TenantsInFlight[tenant] = n
+	} else {
+		delete(d.metrics.TenantsInFlight, tenant)
+	}
+	d.metrics.mux.Unlock()
+}
+
+// MetricAddScalingDecision keeps the last maxScalingDecisions decisions
+func (d *dispatcher) MetricAddScalingDecision(sd scalingDecision) {
+	d.metrics.mux.Lock()
+	d.metrics.ScalingDecisions = append(d.metrics.ScalingDecisions, sd)
+	if n := len(d.metrics.ScalingDecisions); n > maxScalingDecisions {
+		d.metrics.ScalingDecisions = d.metrics.ScalingDecisions[n-maxScalingDecisions:]
+	}
+	d.metrics.mux.Unlock()
+}
+
 // Init sets size of work and scheduler channels and then creates them
 //	 Job channels send or wait for jobs to execute
 //	 Done channels allow go routines to be stopped by application
@@ -335,9 +535,15 @@ func (d *dispatcher) Init(dc *dispatcherConfiguration) {
 	dc.SetSane(d)
 
 	d.metrics.Counters = make(map[string]int)
+	d.metrics.TenantsInFlight = make(map[string]int)
 	d.metrics.mux = &sync.Mutex{}
 	d.mux = &sync.Mutex{}
 	d.wg = &sync.WaitGroup{}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	d.stopForward = make(chan bool)
+	d.shutdownOnce = &sync.Once{}
+	d.interruptOnce = &sync.Once{}
+	d.shutdownDone = make(chan bool)
 
 	// Scheduler channels
 	d.schedulerJobChan = make(chan Job, d.conf.sizeOfJobChannel)
@@ -347,23 +553,27 @@ func (d *dispatcher) Init(dc *dispatcherConfiguration) {
 	d.workerJobChan = make(chan Job, d.conf.numberOfWorkers)
 	d.workerJobResponse = make(chan Result, d.conf.numberOfWorkers)
 
-	// Done channels
-	d.schedulerDone = make(chan bool)
-	d.workerDone = make(chan bool)
+	// Done channels, workers get their own when created
+	// schedulerDone is buffered so a stop request never blocks
+	d.schedulerDone = make(chan bool, 1)
+	d.jobChanSwapped = make(chan bool, 1)
 
 	// Interrupt channels
 	d.schedulerInterrupt = make(chan os.Signal)
 	d.workerInterrupt = make(chan os.Signal)
 
 	// Set scheduler internal channels
-	d.scheduler.SetChannels(
-		d.schedulerJobChan,
-		d.schedulerResultChan,
-		d.schedulerDone,
-		d.schedulerInterrupt)
-
+	d.setSchedulerChannels()
+
+	d.autoscaler.Init(d)
+	d.retrier.Init(d)
+	d.timeouts.Init(d)
+	d.queues.Init(d)
+	d.families.Init(d)
+	d.workflows.Init(d)
 	d.managementInit()
 	d.MetricSetStartTime()
+	d.MetricSet(dispatcherTargetWorkers, d.conf.numberOfWorkers)
 
 	return
 }
@@ -395,6 +605,16 @@ func (d *dispatcher) managementInit() {
 		Description: "Starts the worker pool if stopped"}
 	d.managementOptions.Commands = append(d.managementOptions.Commands, newCMD)
 
+	newCMD = mgtCommand{Name: "cancel_job", DataType: "string",
+		CommandType: "command",
+		Description: "Cancels the running job with job_id"}
+	d.managementOptions.Commands = append(d.managementOptions.Commands, newCMD)
+
+	newCMD = mgtCommand{Name: "cancel_jobs", DataType: "string",
+		CommandType: "command",
+		Description: "Cancels every running job"}
+	d.managementOptions.Commands = append(d.managementOptions.Commands, newCMD)
+
 	newCMD = mgtCommand{Name: "shutdown", DataType: "string",
 		CommandType: "command",
 		Description: "Graceful shutdown"}
@@ -405,12 +625,27 @@ func (d *dispatcher) managementInit() {
 		Description: "Hard shutdown with SIGKILL"}
 	d.managementOptions.Commands = append(d.managementOptions.Commands, newCMD)
 
+	newCMD = mgtCommand{Name: "shutdown_status", DataType: "string",
+		CommandType: "command",
+		Description: "Reports the progress of a shutdown"}
+	d.managementOptions.Commands = append(d.managementOptions.Commands, newCMD)
+
 	d.managementOptions.Fields = append(d.managementOptions.Fields,
 		gracefulShutdownSeconds,
 		hardShutdownSeconds,
 		numberOfWorkers,
 		schedulerChannelSize,
 		resultChannelSize)
+	d.managementOptions.Fields = append(d.managementOptions.Fields,
+		d.autoscaler.Fields()...)
+	d.managementOptions.Fields = append(d.managementOptions.Fields,
+		d.retrier.Fields()...)
+	d.managementOptions.Fields = append(d.managementOptions.Fields,
+		d.timeouts.Fields()...)
+	d.managementOptions.Fields = append(d.managementOptions.Fields,
+		d.queues.Fields()...)
+	d.managementOptions.Fields = append(d.managementOptions.Fields,
+		d.families.Fields()...)
 
 	/* TODO: add hooks to allows Job and Scheduler to extend management API
 	d.managementOptions.Commands = append(d.managementOption.Command, s.AddSchedulerCommands())
@@ -421,46 +656,470 @@ func (d *dispatcher) managementInit() {
 	*/
 }
 
-func (d dispatcher) Run() error {
+func (d *dispatcher) Run() error {
 	e := d.createWorkerPool()
 	if e == nil {
+		d.replayJobs()
 		go d.Forwarder()
 		go d.Responder()
+		go d.autoscaler.Run()
 		return nil
 	}
 
 	return e
 }
 
-func (d dispatcher) Forwarder() {
+// Forwarder queues jobs from the scheduler by priority class and
+// tenant and passes the next one to the workers when they have room
+func (d *dispatcher) Forwarder() {
+	var next Job // dequeued, waiting for a worker
+
 	for {
+		if next == nil {
+			next = d.queues.Pop()
+		}
+
+		// A nil channel blocks so nothing is sent without a job
+		var workerJobChan chan Job
+		if next != nil {
+			workerJobChan = d.workerJobChan
+		}
+
 		select {
-		case currentJob := <-d.schedulerJobChan:
-			d.MetricInc(dispatcherJobsSent)
-			d.workerJobChan <- currentJob
+		case currentJob := <-d.jobChannel():
+			d.enqueue(currentJob)
+
+		case workerJobChan <- next:
+			next = nil
+
+		case <-d.queues.ready:
+			// A tenant is under its limit or a job was queued
+
+		case <-d.jobChanSwapped:
+			// Loop to pick up the new channel
+
+		case <-d.stopForward:
+			if next != nil {
+				log.Printf("Job: %v abandoned by shutdown\n", next.ID())
+			}
+			return
 		}
 	}
 }
 
-func (d dispatcher) Responder() {
+// enqueue queues j for the workers, it never blocks
+func (d *dispatcher) enqueue(j Job) {
+	d.MetricInc(dispatcherJobsSent)
+	d.persist(j)
+	d.queues.Push(j)
+}
+
+func (d *dispatcher) Responder() {
 	log.Println("Dispatcher result channel started worker result -> scheduler  result")
 	for {
 		select {
 		case currentJobResponse := <-d.workerJobResponse:
 			d.MetricInc(dispatcherResultsReceived)
-			d.schedulerResultChan <- currentJobResponse
+			select {
+			case d.resultChannel() <- currentJobResponse:
+			case <-d.ctx.Done():
+				return
+			}
+
+		case <-d.ctx.Done():
+			return
 		}
 	}
 }
 
-func (d *dispatcher) Shutdown() error {
-	return nil
+// jobChannel returns the current scheduler job channel
+func (d *dispatcher) jobChannel() chan Job {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.schedulerJobChan
+}
+
+// resultChannel returns the current scheduler result channel
+func (d *dispatcher) resultChannel() chan Result {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.schedulerResultChan
+}
+
+// setSchedulerChannels passes the current channels to the scheduler
+func (d *dispatcher) setSchedulerChannels() {
+	d.mux.Lock()
+	jc := d.schedulerJobChan
+	rc := d.schedulerResultChan
+	d.mux.Unlock()
+
+	d.scheduler.SetChannels(jc, rc, d.schedulerDone, d.schedulerInterrupt)
+}
+
+// resizeJobChannel replaces the scheduler job channel with one
+// of the given size, queued jobs are moved to the new channel
+func (d *dispatcher) resizeJobChannel(size int) {
+	d.mux.Lock()
+	old := d.schedulerJobChan
+	d.schedulerJobChan = make(chan Job, size)
+	d.conf.sizeOfJobChannel = size
+	d.mux.Unlock()
+
+	d.setSchedulerChannels()
+
+	select {
+	case d.jobChanSwapped <- true:
+	default:
+	}
+
+	go d.drainJobChannel(old)
+}
+
+// resizeResultChannel replaces the scheduler result channel with one
+// of the given size, queued results are moved to the new channel
+func (d *dispatcher) resizeResultChannel(size int) {
+	d.mux.Lock()
+	old := d.schedulerResultChan
+	d.schedulerResultChan = make(chan Result, size)
+	d.conf.sizeOfResultChannel = size
+	d.mux.Unlock()
+
+	d.setSchedulerChannels()
+
+	go d.drainResultChannel(old)
+}
+
+// drainJobChannel moves jobs from a replaced channel to the current one
+// Jobs created before the resize keep their copy of the old channel, so
+// it is read until the dispatcher stops rather than until it goes quiet
+func (d *dispatcher) drainJobChannel(old chan Job) {
+	for {
+		select {
+		case j := <-old:
+			select {
+			case d.jobChannel() <- j:
+			case <-d.ctx.Done():
+				return
+			}
+		case <-d.ctx.Done():
+			return
+		}
+	}
+}
+
+// drainResultChannel moves results from a replaced channel to the
+// current one, see drainJobChannel
+func (d *dispatcher) drainResultChannel(old chan Result) {
+	for {
+		select {
+		case r := <-old:
+			select {
+			case d.resultChannel() <- r:
+			case <-d.ctx.Done():
+				return
+			}
+		case <-d.ctx.Done():
+			return
+		}
+	}
+}
+
+// shutdownSummary reports what happened to outstanding work
+type shutdownSummary struct {
+	// JobsCompleted finished while shutting down
+	JobsCompleted int `json:"jobs_completed"`
+
+	// JobsAbandoned were still queued or running at the deadline
+	JobsAbandoned int `json:"jobs_abandoned"`
+
+	// TimedOut is true if the deadline passed before workers exited
+	TimedOut bool `json:"timed_out"`
+
+	// Duration of the shutdown
+	Duration time.Duration `json:"duration"`
+}
+
+// Shutdown stops the scheduler, lets queued and in flight jobs finish
+// within the graceful (or hard) shutdown period, flushes their results
+// to the scheduler, and stops the dispatcher.  A hard shutdown also
+// interrupts idle workers and the scheduler right away.
+//
+// Only the first call does any work, later calls return an empty summary
+func (d *dispatcher) Shutdown(ctx context.Context, hard bool) (summary shutdownSummary, err error) {
+	ran := false
+	d.shutdownOnce.Do(func() {
+		ran = true
+		sctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		d.mux.Lock()
+		d.shuttingDown = true
+		d.shutdownCancel = cancel
+		escalated := d.shutdownEscalate
+		d.mux.Unlock()
+		if escalated {
+			cancel()
+		}
+
+		summary, err = d.shutdown(sctx, hard)
+
+		d.mux.Lock()
+		d.shutdownSummary = summary
+		d.mux.Unlock()
+		close(d.shutdownDone)
+	})
+
+	if !ran {
+		return summary, errors.New("shutdown already initiated")
+	}
+	return summary, err
+}
+
+// startShutdown runs Shutdown in the background, it returns false if
+// a shutdown has already been started
+func (d *dispatcher) startShutdown(hard bool) bool {
+	d.mux.Lock()
+	if d.shuttingDown {
+		d.mux.Unlock()
+		return false
+	}
+	d.shuttingDown = true
+	d.mux.Unlock()
+
+	go func() {
+		summary, e := d.Shutdown(context.Background(), hard)
+		if e != nil {
+			log.Println("Shutdown failed:", e)
+			return
+		}
+		log.Printf("Shutdown summary: %+v\n", summary)
+	}()
+	return true
+}
+
+// escalateShutdown turns a graceful shutdown in progress into a hard
+// one, running jobs are cancelled and results are no longer waited for
+func (d *dispatcher) escalateShutdown() {
+	d.interrupt()
+
+	d.mux.Lock()
+	d.shutdownEscalate = true
+	cancel := d.shutdownCancel
+	d.mux.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// shutdownFinished is closed once a shutdown has completed
+func (d *dispatcher) shutdownFinished() <-chan bool {
+	return d.shutdownDone
+}
+
+// shutdownStatus reports whether a shutdown has been started, and once
+// it has finished what happened to outstanding work
+func (d *dispatcher) shutdownStatus() (started, finished bool, summary shutdownSummary) {
+	select {
+	case <-d.shutdownDone:
+		finished = true
+	default:
+	}
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.shuttingDown, finished, d.shutdownSummary
+}
+
+func (d *dispatcher) shutdown(ctx context.Context, hard bool) (shutdownSummary, error) {
+	var summary shutdownSummary
+	start := time.Now()
+	completedBefore := d.MetricValue(dispatcherResultsReceived)
+	d.MetricInc(dispatcherShutdowns)
+
+	d.mux.Lock()
+	grace := time.Duration(d.conf.gracefulShutdown) * time.Second
+	if hard {
+		grace = time.Duration(d.conf.hardShutdown) * time.Second
+	}
+	d.mux.Unlock()
+
+	deadline := time.Now().Add(grace)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	log.Printf("Shutdown started, hard: %v, deadline: %v\n", hard, deadline)
+
+	// Stop new jobs from being scheduled
+	if e := d.scheduler.Shutdown(); e != nil {
+		log.Println("Scheduler shutdown failed:", e)
+	}
+
+	if hard {
+		d.interrupt()
+	} else {
+		// Let the workers drain jobs already queued
+		d.waitFor(ctx, deadline, func() bool {
+			return len(d.jobChannel()) == 0 && d.queues.Len() == 0 &&
+				len(d.workerJobChan) == 0
+		})
+	}
+
+	// Nothing new reaches the workers after this
+	close(d.stopForward)
+	d.stopWorkerPool()
+	summary.JobsAbandoned = d.drainQueuedJobs()
+
+	// Wait for jobs in flight
+	workersDone := make(chan bool)
+	go func() {
+		d.wg.Wait()
+		close(workersDone)
+	}()
+
+	select {
+	case <-workersDone:
+	case <-time.After(time.Until(deadline)):
+		summary.TimedOut = true
+	case <-ctx.Done():
+		summary.TimedOut = true
+	}
+
+	// Jobs still running are cancelled
+	if summary.TimedOut {
+		d.timeouts.CancelAll()
+	}
+
+	d.mux.Lock()
+	summary.JobsAbandoned += d.inFlight
+	d.mux.Unlock()
+
+	// Parents whose children were abandoned report what finished
+	for _, o := range d.families.release() {
+		d.workflows.finished(o)
+		select {
+		case d.workerJobResponse <- o.result:
+		case <-time.After(time.Until(deadline)):
+		case <-ctx.Done():
+		}
+	}
+
+	// Workflow steps whose jobs didn't finish won't
+	d.workflows.cancelRunning()
+
+	// Flush results from finished jobs to the scheduler
+	d.waitFor(ctx, deadline, func() bool {
+		return len(d.workerJobResponse) == 0
+	})
+
+	// Jobs waiting to be retried are dropped
+	summary.JobsAbandoned += d.retrier.Pending()
+
+	fctx, fcancel := context.WithDeadline(ctx, deadline)
+	if e := d.scheduler.FlushResults(fctx); e != nil {
+		log.Println("Flushing results failed:", e)
+	}
+	fcancel()
+
+	d.cancel()
+
+	// Unfinished durable jobs stay in the store for the next start
+	if d.jobStore != nil {
+		if e := d.jobStore.Close(); e != nil {
+			log.Println("Closing job queue failed:", e)
+		}
+	}
+
+	summary.JobsCompleted = d.MetricValue(dispatcherResultsReceived) - completedBefore
+	summary.Duration = time.Since(start)
+	log.Printf("Shutdown complete, completed: %d, abandoned: %d, timed out: %v\n",
+		summary.JobsCompleted, summary.JobsAbandoned, summary.TimedOut)
+
+	return summary, nil
+}
+
+// waitFor polls until done returns true, the deadline passes
+// or ctx is cancelled
+func (d *dispatcher) waitFor(ctx context.Context, deadline time.Time, done func() bool) {
+	for !done() && time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// drainQueuedJobs empties the job channels and priority queues
+// returning the number of jobs removed
+func (d *dispatcher) drainQueuedJobs() int {
+	drained := 0
+	jc := d.jobChannel()
+
+	for _, j := range d.queues.Drain() {
+		log.Printf("Job: %v abandoned by shutdown\n", j.ID())
+		drained++
+	}
+
+	for {
+		select {
+		case j := <-jc:
+			log.Printf("Job: %v abandoned by shutdown\n", j.ID())
+			drained++
+		case j := <-d.workerJobChan:
+			log.Printf("Job: %v abandoned by shutdown\n", j.ID())
+			drained++
+		default:
+			return drained
+		}
+	}
+}
+
+// interrupt tells every goroutine reading an interrupt channel to exit
+// Closing broadcasts to all readers where a send reaches only one
+func (d *dispatcher) interrupt() {
+	d.interruptOnce.Do(func() {
+		close(d.schedulerInterrupt)
+		close(d.workerInterrupt)
+		d.timeouts.CancelAll()
+	})
+}
+
+// jobStarted and jobFinished track jobs in flight
+func (d *dispatcher) jobStarted() {
+	d.mux.Lock()
+	d.inFlight++
+	n := d.inFlight
+	d.mux.Unlock()
+	d.MetricSet(dispatcherJobsInFlight, n)
+}
+
+func (d *dispatcher) jobFinished() {
+	d.mux.Lock()
+	d.inFlight--
+	n := d.inFlight
+	d.mux.Unlock()
+	d.MetricSet(dispatcherJobsInFlight, n)
 }
 
 // SetConfigVariable changegs the value of a given field
 func (d *dispatcher) SetConfigVariable(name string, value int) (msg []byte, err error) {
 	var rmsg string
 
+	// Retry fields include the job type in the name
+	if d.retrier.Handles(name) {
+		return d.retrier.SetConfigVariable(name, value)
+	}
+	if d.timeouts.Handles(name) {
+		return d.timeouts.SetConfigVariable(name, value)
+	}
+	if d.queues.Handles(name) {
+		return d.queues.SetConfigVariable(name, value)
+	}
+	if d.families.Handles(name) {
+		return d.families.SetConfigVariable(name, value)
+	}
+
 	switch name {
 	case gracefulShutdownSeconds:
 		d.mux.Lock()
@@ -481,25 +1140,67 @@ func (d *dispatcher) SetConfigVariable(name string, value int) (msg []byte, err
 		return []byte(rmsg), nil
 
 	case numberOfWorkers:
+		if value < 1 {
+			rmsg = fmt.Sprintf("{\"Status\": \"%s must be greater than 0\"}", name)
+			e := errors.New("invalid number of workers")
+			return []byte(rmsg), e
+		}
+
 		d.mux.Lock()
 		old := d.conf.numberOfWorkers
 		d.conf.numberOfWorkers = value
+		active := d.workersActive
 		d.mux.Unlock()
+		d.MetricSet(dispatcherTargetWorkers, value)
+
+		// A stopped pool picks up the new size on start_workers
+		if active {
+			if e := d.resizeWorkerPool(); e != nil {
+				rmsg = fmt.Sprintf("{\"Status\": \"%s resize failed: %v\"}", name, e)
+				return []byte(rmsg), e
+			}
+		}
 
-		//TODO: grow or srink as necessary
 		rmsg = fmt.Sprintf("{\"Status\": \"%s changed from %d to %d\"}",
 			name, old, value)
 		return []byte(rmsg), nil
 
+	case autoscaleEnabled, minNumberOfWorkers, maxNumberOfWorkers,
+		autoscaleBacklogHigh, autoscaleBacklogLow, autoscaleLatencyHigh,
+		autoscaleCooldownSeconds:
+		return d.autoscaler.SetConfigVariable(name, value)
+
 	case schedulerChannelSize:
-		rmsg = fmt.Sprintf("{\"Status\": \"%s not implemented\"}", name)
-		e := errors.New("not implemented")
-		return []byte(rmsg), e
+		if value < 1 {
+			rmsg = fmt.Sprintf("{\"Status\": \"%s must be greater than 0\"}", name)
+			e := errors.New("invalid channel size")
+			return []byte(rmsg), e
+		}
+
+		d.mux.Lock()
+		old := d.conf.sizeOfJobChannel
+		d.mux.Unlock()
+		d.resizeJobChannel(value)
+
+		rmsg = fmt.Sprintf("{\"Status\": \"%s changed from %d to %d\"}",
+			name, old, value)
+		return []byte(rmsg), nil
 
 	case resultChannelSize:
-		rmsg = fmt.Sprintf("{\"Status\": \"%s not implemented\"}", name)
-		e := errors.New("not implemented")
-		return []byte(rmsg), e
+		if value < 1 {
+			rmsg = fmt.Sprintf("{\"Status\": \"%s must be greater than 0\"}", name)
+			e := errors.New("invalid channel size")
+			return []byte(rmsg), e
+		}
+
+		d.mux.Lock()
+		old := d.conf.sizeOfResultChannel
+		d.mux.Unlock()
+		d.resizeResultChannel(value)
+
+		rmsg = fmt.Sprintf("{\"Status\": \"%s changed from %d to %d\"}",
+			name, old, value)
+		return []byte(rmsg), nil
 	default:
 		rmsg = fmt.Sprintf("{\"Status\": \"%s unknown\"}", name)
 		e := errors.New("unknown set field")
@@ -521,25 +1222,43 @@ func (d *dispatcher) ProcessManagementRequest(r managementRequest) (httpStatusCo
 		return http.StatusOK, []byte(msg), nil
 
 	case "stop_scheduler":
-		d.schedulerDone <- true
+		if e := d.scheduler.Pause(); e != nil {
+			msg := fmt.Sprintf("{\"Status\": \"couldn't stop scheduler: %v\"}", e)
+			return http.StatusExpectationFailed, []byte(msg), nil
+		}
 		msg := fmt.Sprintf("{\"Status\": \"Scheduler stop initiated\"}")
 		return http.StatusOK, []byte(msg), nil
 
 	case "start_scheduler":
-		// TODO: this will require changes to the scheduler interface
+		var e error
+		st := d.scheduler.Status()
+
+		switch {
+		case st.SchedulerRunning && st.ResultCollectorRunning && !st.SchedulerPaused:
+			msg := fmt.Sprintf("{\"Status\": \"Scheduler already running\"}")
+			return http.StatusOK, []byte(msg), nil
+		case st.SchedulerRunning && st.ResultCollectorRunning:
+			e = d.scheduler.Resume()
+		default:
+			e = d.scheduler.Restart()
+		}
+
+		if e != nil {
+			msg := fmt.Sprintf("{\"Status\": \"couldn't start scheduler: %v\"}", e)
+			return http.StatusExpectationFailed, []byte(msg), nil
+		}
 		msg := fmt.Sprintf("{\"Status\": \"Scheduler start initiated\"}")
 		return http.StatusOK, []byte(msg), nil
 
 	case "stop_workers":
-		d.workerDone <- true
-		d.conf.currentNumberOfWorkers = 0
+		d.stopWorkerPool()
 		msg := fmt.Sprintf("{\"Status\": \"Worker stop initiated\"}")
 		return http.StatusOK, []byte(msg), nil
 
 	case "start_workers":
-		if d.conf.currentNumberOfWorkers > 0 {
+		if active := d.activeWorkers(); active > 0 {
 			msg := fmt.Sprintf("{\"Status\": \"%v already running\"}",
-				d.conf.currentNumberOfWorkers)
+				active)
 			return http.StatusBadRequest, []byte(msg), nil
 		}
 
@@ -552,21 +1271,36 @@ func (d *dispatcher) ProcessManagementRequest(r managementRequest) (httpStatusCo
 		msg := fmt.Sprintf("{\"Status\": \"Worker stop initiated\"}")
 		return http.StatusOK, []byte(msg), nil
 
-		//TODO: move this logic into Shutdown() method
-	case "shutdown":
-		// Let the scheduler clean up if special logic is needed
-		// d.scheduler.Shutdown()
-		d.schedulerDone <- true
-		d.workerDone <- true
-		msg := fmt.Sprintf("{\"Status\": \"Shutdown complete\"}")
+	case "cancel_job":
+		if d.timeouts.Cancel(r.JobID) == 0 {
+			msg := fmt.Sprintf("{\"Status\": \"Job %s is not running\"}", r.JobID)
+			return http.StatusNotFound, []byte(msg), nil
+		}
+		msg := fmt.Sprintf("{\"Status\": \"Job %s cancelled\"}", r.JobID)
 		return http.StatusOK, []byte(msg), nil
 
-	case "shutdown_now":
-		d.schedulerInterrupt <- syscall.SIGINT
-		d.workerInterrupt <- syscall.SIGINT
-		msg := fmt.Sprintf("{\"Status\": \"shutdown_now complete\"}")
+	case "cancel_jobs":
+		n := d.timeouts.CancelRunning()
+		msg := fmt.Sprintf("{\"Status\": \"%d jobs cancelled\"}", n)
 		return http.StatusOK, []byte(msg), nil
 
+	case "shutdown", "shutdown_now":
+		hard := r.Command == "shutdown_now"
+		if d.startShutdown(hard) {
+			msg := fmt.Sprintf("{\"Status\": \"%s initiated\"}", r.Command)
+			return http.StatusAccepted, []byte(msg), nil
+		}
+
+		if hard {
+			d.escalateShutdown()
+			msg := fmt.Sprintf("{\"Status\": \"Shutdown escalated to %s\"}", r.Command)
+			return http.StatusAccepted, []byte(msg), nil
+		}
+		return d.shutdownStatusResponse()
+
+	case "shutdown_status":
+		return d.shutdownStatusResponse()
+
 	default:
 		msg := fmt.Sprintf("{\"Status\": \"Command %s not implemented\"}",
 			r.Command)
@@ -575,30 +1309,132 @@ func (d *dispatcher) ProcessManagementRequest(r managementRequest) (httpStatusCo
 
 }
 
+// shutdownStatusResponse reports a shutdown in progress with 202
+// and a finished one with 200 and what happened to outstanding work
+func (d *dispatcher) shutdownStatusResponse() (int, []byte, error) {
+	started, finished, summary := d.shutdownStatus()
+
+	switch {
+	case !started:
+		msg := fmt.Sprintf("{\"Status\": \"Not shutting down\"}")
+		return http.StatusOK, []byte(msg), nil
+	case !finished:
+		msg := fmt.Sprintf("{\"Status\": \"Shutdown in progress\"}")
+		return http.StatusAccepted, []byte(msg), nil
+	}
+
+	msg := fmt.Sprintf("{\"Status\": \"Shutdown complete\", \"jobs_completed\": %d, \"jobs_abandoned\": %d, \"timed_out\": %v}",
+		summary.JobsCompleted, summary.JobsAbandoned, summary.TimedOut)
+	return http.StatusOK, []byte(msg), nil
+}
+
+// createWorkerPool starts workers until the pool matches the
+// configured number of workers
 func (d *dispatcher) createWorkerPool() error {
-	for i := 0; i < d.conf.numberOfWorkers; i++ {
-		newWorker := worker{wg: d.wg,
+	d.mux.Lock()
+	d.workersActive = true
+	d.mux.Unlock()
+
+	e := d.resizeWorkerPool()
+	if e != nil {
+		return e
+	}
+
+	log.Printf("Worker pool created, %d workers\n", d.activeWorkers())
+	return nil
+}
+
+// stopWorkerPool retires every worker, jobs in flight complete
+func (d *dispatcher) stopWorkerPool() {
+	d.mux.Lock()
+	d.workersActive = false
+	n := len(d.workers)
+	d.mux.Unlock()
+
+	d.srinkWorkerPool(n)
+}
+
+// resizeWorkerPool grows or shrinks the pool to the target size
+func (d *dispatcher) resizeWorkerPool() error {
+	d.mux.Lock()
+	target := d.conf.numberOfWorkers
+	active := len(d.workers)
+	d.mux.Unlock()
+
+	switch {
+	case target > active:
+		return d.growWorkerPool(target - active)
+	case target < active:
+		return d.srinkWorkerPool(active - target)
+	}
+
+	return nil
+}
+
+// activeWorkers returns the number of workers not asked to retire
+func (d *dispatcher) activeWorkers() int {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return len(d.workers)
+}
+
+// growWorkerPool starts n new workers
+func (d *dispatcher) growWorkerPool(n int) error {
+	for i := 0; i < n; i++ {
+		d.mux.Lock()
+		d.nextWorkerID++
+		newWorker := &worker{id: d.nextWorkerID,
+			d:            d,
+			wg:           d.wg,
 			jobChan:      d.workerJobChan,
 			responseChan: d.workerJobResponse,
 			interrupt:    d.workerInterrupt,
-			done:         d.workerDone}
+			done:         make(chan bool)}
 
 		d.wg.Add(1)
 
 		// Keep track of each worker
-		d.workers = append(d.workers, &newWorker)
+		d.workers = append(d.workers, newWorker)
+		d.conf.currentNumberOfWorkers++
+		current := d.conf.currentNumberOfWorkers
+		d.mux.Unlock()
 
-		go newWorker.Run()
+		d.MetricInc(dispatcherWorkersStarted)
+		d.MetricSet(dispatcherCurrentWorkers, current)
+
+		go d.supervise(newWorker)
 	}
-	d.conf.currentNumberOfWorkers = d.conf.numberOfWorkers
-	log.Printf("Worker pool created, %d workers\n", d.conf.numberOfWorkers)
+
 	return nil
 }
 
-func (d *dispatcher) growWorkerPool() error {
+// srinkWorkerPool asks the n most recently started workers to retire
+// Each one exits after its current job, see workerRetired
+func (d *dispatcher) srinkWorkerPool(n int) error {
+	d.mux.Lock()
+	if n > len(d.workers) {
+		n = len(d.workers)
+	}
+	keep := len(d.workers) - n
+	retiring := d.workers[keep:]
+	d.workers = d.workers[:keep:keep]
+	d.mux.Unlock()
+
+	for _, w := range retiring {
+		close(w.done)
+	}
+
 	return nil
 }
 
-func (d *dispatcher) srinkWorkerPool() error {
-	return nil
+// workerRetired keeps the live worker count accurate as workers exit
+func (d *dispatcher) workerRetired(w *worker) {
+	d.mux.Lock()
+	d.conf.currentNumberOfWorkers--
+	current := d.conf.currentNumberOfWorkers
+	d.mux.Unlock()
+
+	d.MetricInc(dispatcherWorkersRetired)
+	d.MetricSet(dispatcherCurrentWorkers, current)
+	log.Printf("Worker %d retired, %d workers running\n", w.id, current)
 }
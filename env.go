@@ -24,6 +24,13 @@ type Environment struct {
 }
 
 func (e *Environment) get() Environment {
+	_ = e.load()
+	return *e
+}
+
+// load reads the environment file and applies environment variable
+// overrides, returning an error if the file can't be read
+func (e *Environment) load() error {
 	envname := defaultEnvironment
 
 	newValue := os.Getenv("PR_BACKEND_END")
@@ -34,10 +41,10 @@ func (e *Environment) get() Environment {
 	fn := envdir + envname + ".yaml"
 	_, err := e.LoadFromDisk(fn)
 	if err != nil {
-		return *e
+		return err
 	}
 	e.Patch()
-	return *e
+	return nil
 }
 
 //Patch overload defaults from environment variables
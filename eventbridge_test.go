@@ -3,15 +3,22 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	_ "strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/google/uuid"
+	"github.com/pavedroad-io/eventbridge/s3"
 )
 
 const (
@@ -23,10 +30,12 @@ const (
 	ManagementURL string = "/api/v1/namespace/" + Namespace + "/" + Service + "/management"
 	JobURL        string = "/api/v1/namespace/" + Namespace + "/" + Service + "/jobs"
 	JobListURL    string = "/api/v1/namespace/" + Namespace + "/" + Service + "/jobsLIST"
+	DeadLetterURL string = "/api/v1/namespace/" + Namespace + "/" + Service + "/jobs/deadletters"
 	ScheduleURL   string = "/api/v1/namespace/" + Namespace + "/" + Service + "/scheduler"
 	ReadyURL      string = "/api/v1/namespace/" + Namespace + "/" + Service + "/ready"
 	LiveURL       string = "/api/v1/namespace/" + Namespace + "/" + Service + "/liveness"
 	MetricsURL    string = "/api/v1/namespace/" + Namespace + "/" + Service + "/metrics"
+	WorkflowURL   string = "/api/v1/namespace/" + Namespace + "/" + Service + "/workflows"
 )
 
 var newEventbridgeJSON = ``
@@ -48,6 +57,81 @@ func TestMain(m *testing.M) {
 	defer os.Exit(m.Run())
 }
 
+// testJobType runs without the customer service or S3 so tests can
+// create jobs through the API
+const testJobType = "io.pavedroad.eventbridge.test"
+
+const testJobSchema = `{
+	"type": "object",
+	"properties": {
+		"name": {"type": "string"},
+		"fail": {"type": "boolean"}
+	},
+	"additionalProperties": false
+}`
+
+var errTestJobFailed = errors.New("test job failed")
+
+// testJobRuns payloads of the test jobs run, in order
+var testJobRuns = struct {
+	names []string
+	mux   sync.Mutex
+}{}
+
+// testJob records its run and fails if Fail is set, its payload is
+// its name followed by the inputs workflow steps passed it
+type testJob struct {
+	JobID  uuid.UUID `json:"job_id"`
+	Name   string    `json:"name"`
+	Fail   bool      `json:"fail"`
+	Inputs []string  `json:"inputs,omitempty"`
+}
+
+func (j *testJob) ID() string                         { return j.JobID.String() }
+func (j *testJob) Type() string                       { return testJobType }
+func (j *testJob) Init() error                        { j.JobID = uuid.New(); return nil }
+func (j *testJob) InitWithJobChan(job chan Job) error { return j.Init() }
+func (j *testJob) Pause() (string, error)             { return "", nil }
+func (j *testJob) Shutdown() error                    { return nil }
+func (j *testJob) Errors() []error                    { return nil }
+func (j *testJob) Metrics() []byte                    { return []byte("{}") }
+
+// SetInput keeps the payload of the workflow step that triggered j
+func (j *testJob) SetInput(step string, payload []byte) {
+	j.Inputs = append(j.Inputs, step+":"+string(payload))
+}
+
+func (j *testJob) Run(ctx context.Context) (Result, error) {
+	payload := j.Name
+	if len(j.Inputs) > 0 {
+		payload += "<" + strings.Join(j.Inputs, ",") + ">"
+	}
+
+	testJobRuns.mux.Lock()
+	testJobRuns.names = append(testJobRuns.names, payload)
+	testJobRuns.mux.Unlock()
+
+	jd, _ := json.Marshal(j)
+	jrsp := &logResult{job: jd, jobType: testJobType, payload: []byte(payload)}
+	if j.Fail {
+		return jrsp.LogErrorResults(j, errTestJobFailed)
+	}
+	return jrsp, nil
+}
+
+// testJobRan returns the payloads of the test jobs run in order
+func testJobRan() []string {
+	testJobRuns.mux.Lock()
+	defer testJobRuns.mux.Unlock()
+	return append([]string(nil), testJobRuns.names...)
+}
+
+// JobTestMain registers the job types used by the tests
+func JobTestMain() {
+	RegisterJobType(testJobType, func() Job { return &testJob{} })
+	RegisterJobSchema(testJobType, testJobSchema)
+}
+
 func testExit() {
 	data := "{\"command\": \"shutdown_now\", \"field\": \"\", \"field_value\": 0}"
 	req, _ := http.NewRequest("PUT", ManagementURL, strings.NewReader(data))
@@ -68,6 +152,22 @@ func TestSchedule(t *testing.T) {
 		response = executeRequest(req)
 		checkResponseCode(t, http.StatusOK, response.Code)
 
+		crondata := "{\"schedule_type\": \"Cron scheduler\", \"cron_expression\": \"5 * * * *\"}"
+		req, _ = http.NewRequest("PUT", ScheduleURL, strings.NewReader(crondata))
+		response = executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+
+		req, _ = http.NewRequest("GET", ScheduleURL, nil)
+		response = executeRequest(req)
+		if !strings.Contains(response.Body.String(), ":05:00Z") {
+			t.Errorf("Expected next run at :05; Got %v\n", response.Body.String())
+		}
+
+		baddata := "{\"cron_expression\": \"61 * * * *\"}"
+		req, _ = http.NewRequest("PUT", ScheduleURL, strings.NewReader(baddata))
+		response = executeRequest(req)
+		checkResponseCode(t, http.StatusBadRequest, response.Code)
+
 		req, _ = http.NewRequest("DELETE", ScheduleURL, strings.NewReader(putdata))
 		response = executeRequest(req)
 		checkResponseCode(t, http.StatusOK, response.Code)
@@ -80,6 +180,920 @@ func TestSchedule(t *testing.T) {
 	return
 }
 
+func TestCronSchedule(t *testing.T) {
+	from := time.Date(2021, time.October, 15, 10, 30, 0, 0, time.UTC) // Friday
+
+	tc := map[string]time.Time{
+		"5 * * * *":        time.Date(2021, time.October, 15, 11, 5, 0, 0, time.UTC),
+		"0 2 * * mon-fri":  time.Date(2021, time.October, 18, 2, 0, 0, 0, time.UTC),
+		"*/15 * * * *":     time.Date(2021, time.October, 15, 10, 45, 0, 0, time.UTC),
+		"@monthly":         time.Date(2021, time.November, 1, 0, 0, 0, 0, time.UTC),
+		"0 0 29 feb *":     time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC),
+		"30 10 1,15 * sun": time.Date(2021, time.October, 17, 10, 30, 0, 0, time.UTC),
+	}
+
+	for expr, expect := range tc {
+		cs, e := parseCron(expr, time.UTC)
+		if e != nil {
+			t.Errorf("%s: unexpected error %v", expr, e)
+			continue
+		}
+		if next := cs.Next(from); !next.Equal(expect) {
+			t.Errorf("%s: expected %v; Got %v", expr, expect, next)
+		}
+	}
+
+	for _, expr := range []string{"* * * *", "60 * * * *", "0 0 30 feb *", "*/0 * * * *", "0 0 * * xyz"} {
+		if _, e := parseCron(expr, time.UTC); e == nil {
+			t.Errorf("%s: expected an error", expr)
+		}
+	}
+}
+
+func TestJobSchedule(t *testing.T) {
+	s := eventScheduler{}
+	s.Init()
+	start := time.Now()
+
+	tc := map[string]int{
+		"{\"interval_seconds\": 60}": http.StatusCreated,
+		"{\"enabled\": false}":       http.StatusCreated,
+		"{\"interval_seconds\": 60, \"cron_expression\": \"5 * * * *\"}":   http.StatusBadRequest,
+		"{\"cron_expression\": \"5 * * * *\", \"time_zone\": \"Nowhere\"}": http.StatusBadRequest,
+		"{\"jitter_seconds\": -1}": http.StatusBadRequest,
+	}
+	for body, expect := range tc {
+		if status, msg, _ := s.CreateScheduleJob([]byte(body)); status != expect {
+			t.Errorf("%s: expected %d; Got %d %s", body, expect, status, msg)
+		}
+	}
+
+	// The default job and the 60 second job are due now,
+	// the disabled job never is
+	if due := s.dueJobs(start.Add(time.Second)); len(due) != 2 {
+		t.Errorf("Expected 2 jobs due; Got %d", len(due))
+	}
+	if due := s.dueJobs(start.Add(30 * time.Second)); len(due) != 0 {
+		t.Errorf("Expected 0 jobs due; Got %d", len(due))
+	}
+	if due := s.dueJobs(start.Add(62 * time.Second)); len(due) != 1 {
+		t.Errorf("Expected 1 job due; Got %d", len(due))
+	}
+
+	// Jitter delays each run without the schedule drifting
+	s.CreateScheduleJob([]byte("{\"interval_seconds\": 60, \"jitter_seconds\": 30}"))
+	jl := s.jobs()
+	timer := s.timers[jl[len(jl)-1].ID()]
+	first := timer.next.Add(-timer.jitter)
+	for i := 0; i < 20; i++ {
+		s.dueJobs(timer.next)
+	}
+	if due := first.Add(20 * time.Minute); timer.next.Before(due) || timer.next.After(due.Add(30*time.Second)) {
+		t.Errorf("Expected the 21st run between %v and 30s later; Got %v", due, timer.next)
+	}
+
+	// Concurrency policies
+	if status, msg, _ := s.CreateScheduleJob([]byte("{\"concurrency_policy\": \"sometimes\"}")); status != http.StatusBadRequest {
+		t.Errorf("Expected %d; Got %d %s", http.StatusBadRequest, status, msg)
+	}
+
+	for _, policy := range []string{"forbid", "replace", "allow"} {
+		s.CreateScheduleJob([]byte("{\"concurrency_policy\": \"" + policy + "\"}"))
+		jl := s.jobs()
+		j := jl[len(jl)-1]
+
+		first := s.newRun(j)
+		second := s.newRun(j)
+		running, skipped := s.jobRuns(j.ID())
+
+		switch policy {
+		case "forbid":
+			if second != nil || running != 1 || skipped != 1 {
+				t.Errorf("forbid: expected 1 running 1 skipped; Got %d %d", running, skipped)
+			}
+		case "replace":
+			if second == nil || !first.superseded || running != 2 {
+				t.Errorf("replace: expected first run superseded; Got %d running", running)
+			}
+		case "allow":
+			if second == nil || first.Job == second.Job || running != 2 {
+				t.Errorf("allow: expected 2 independent runs; Got %d running", running)
+			}
+		}
+
+		s.runFinished(first)
+		if second != nil {
+			s.runFinished(second)
+		}
+		if running, _ = s.jobRuns(j.ID()); running != 0 {
+			t.Errorf("%s: expected 0 running; Got %d", policy, running)
+		}
+	}
+
+	if v := s.MetricValue(skippedRuns); v != 1 {
+		t.Errorf("Expected 1 skipped run; Got %d", v)
+	}
+}
+
+func TestResultMetrics(t *testing.T) {
+	s := eventScheduler{}
+	s.Init()
+
+	// Run times 1 to 12 ms, only the last 10 are kept
+	for i := 1; i <= 12; i++ {
+		j := &logProcessorJob{}
+		j.Init()
+		j.Stats.RequestTime = time.Duration(i) * time.Millisecond
+		j.Stats.RequestTimedOut = i == 12
+		jd, _ := json.Marshal(j)
+		s.processResult(&logResult{job: jd, jobType: j.Type()})
+	}
+
+	// A failed job
+	j := &logProcessorJob{}
+	j.Init()
+	r := &logResult{}
+	failed, _ := r.LogErrorResults(j, errors.New("failed"))
+	s.processResult(failed)
+
+	tc := map[string]int{
+		resultsReceived:          13,
+		resultsSucceeded:         12,
+		resultsFailed:            1,
+		numberOfJobTimedOut:      1,
+		averageJobProcessingTime: 7,
+		jobProcessingTimeP50:     7,
+		jobProcessingTimeP95:     12,
+		jobProcessingTimeP99:     12,
+	}
+	for key, expect := range tc {
+		if v := s.MetricValue(key); v != expect {
+			t.Errorf("%s: expected %d; Got %d", key, expect, v)
+		}
+	}
+
+	if jm := s.metrics.JobTypes[LogProcessorJobType]; jm == nil || jm.Succeeded != 12 || jm.Failed != 1 {
+		t.Errorf("Expected 12 succeeded and 1 failed for %s; Got %+v", LogProcessorJobType, jm)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	rt := &a.Dispatcher.retrier
+
+	// Backoff doubles with up to half of it as jitter
+	for attempt, max := range map[int]time.Duration{1: time.Second, 3: 4 * time.Second, 20: time.Minute} {
+		if b := rt.backoff(attempt); b < max/2 || b > max {
+			t.Errorf("attempt %d: expected backoff between %v and %v; Got %v", attempt, max/2, max, b)
+		}
+	}
+
+	j := &logProcessorJob{}
+	j.Init()
+	if attempt, max := rt.Attempt(j); attempt != 1 || max != 3 {
+		t.Errorf("Expected attempt 1 of 3; Got %d of %d", attempt, max)
+	}
+	if attempt, _ := rt.Attempt(j); attempt != 2 {
+		t.Errorf("Expected attempt 2; Got %d", attempt)
+	}
+	rt.Done(j)
+
+	failed, _ := (&logResult{}).LogErrorResults(j, errors.New("HTTP POST failed"))
+	if e := jobFailed(j, failed, nil); e == nil || e.Error() != "HTTP POST failed" {
+		t.Errorf("Expected HTTP POST failed; Got %v", e)
+	}
+	if e := jobFailed(j, &logResult{}, nil); e != nil {
+		t.Errorf("Expected success; Got %v", e)
+	}
+
+	attemptMetaData(failed, 3, 3)
+	if md := failed.MetaData(); md[metaDataAttempt] != "3" || md[metaDataMaxAttempts] != "3" {
+		t.Errorf("Expected attempt metadata; Got %v", md)
+	}
+
+	msg, e := a.Dispatcher.SetConfigVariable(retryMaxAttemptsPrefix+LogProcessorJobType, 5)
+	er := "{\"Status\": \"" + retryMaxAttemptsPrefix + LogProcessorJobType + " changed from 3 to 5\"}"
+	if e != nil || string(msg) != er {
+		t.Errorf("Expected %s; Got %s", er, msg)
+	}
+	a.Dispatcher.SetConfigVariable(retryMaxAttemptsPrefix+LogProcessorJobType, 3)
+}
+
+func TestDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := a.Dispatcher.deadLetters
+	a.Dispatcher.deadLetters = newDiskDeadLetterStore(dir)
+	defer func() { a.Dispatcher.deadLetters = saved }()
+
+	j := &logProcessorJob{}
+	j.Init()
+	j.Log.ID = "acme"
+	r, _ := (&logResult{}).LogErrorResults(j, errors.New("HTTP POST failed"))
+	a.Dispatcher.deadLetter(j, r, errors.New("ignored"), 3)
+
+	req, _ := http.NewRequest("GET", DeadLetterURL, nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var list []deadLetter
+	if err := json.Unmarshal(response.Body.Bytes(), &list); err != nil || len(list) != 1 {
+		t.Fatalf("Expected one dead letter; Got %s", response.Body.String())
+	}
+	dl := list[0]
+	if dl.JobID != j.ID() || dl.Attempts != 3 || dl.Error != "HTTP POST failed" ||
+		dl.LogItem == nil || dl.LogItem.ID != "acme" {
+		t.Errorf("Unexpected dead letter %+v", dl)
+	}
+
+	req, _ = http.NewRequest("GET", DeadLetterURL+"/"+dl.ID, nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("DELETE", DeadLetterURL+"/"+dl.ID, nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("POST", DeadLetterURL+"/"+dl.ID+"/replay", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	// Ids are UUIDs so they can't escape the store
+	req, _ = http.NewRequest("GET", DeadLetterURL+"/etc.passwd", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func TestJobTimeout(t *testing.T) {
+	jt := &a.Dispatcher.timeouts
+
+	msg, e := a.Dispatcher.SetConfigVariable(jobTimeoutPrefix+LogProcessorJobType, 1)
+	er := "{\"Status\": \"" + jobTimeoutPrefix + LogProcessorJobType + " changed from 300 to 1\"}"
+	if e != nil || string(msg) != er {
+		t.Errorf("Expected %s; Got %s", er, msg)
+	}
+	defer a.Dispatcher.SetConfigVariable(jobTimeoutPrefix+LogProcessorJobType, 300)
+
+	j := &logProcessorJob{}
+	j.Init()
+	ctx, done := jt.Context(j)
+	if dl, ok := ctx.Deadline(); !ok || time.Until(dl) > time.Second {
+		t.Errorf("Expected a deadline within a second; Got %v", dl)
+	}
+
+	// Cancelled through the management API
+	req, _ := http.NewRequest("PUT", ManagementURL,
+		strings.NewReader("{\"command\": \"cancel_job\", \"job_id\": \""+j.ID()+"\"}"))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if ctx.Err() != context.Canceled {
+		t.Errorf("Expected context canceled; Got %v", ctx.Err())
+	}
+	done()
+
+	req, _ = http.NewRequest("PUT", ManagementURL,
+		strings.NewReader("{\"command\": \"cancel_job\", \"job_id\": \""+j.ID()+"\"}"))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	// Overlapping scheduled runs are retried and cancelled on their own
+	var runs []*scheduledRun
+	var ctxs []context.Context
+	for i := 0; i < 2; i++ {
+		r := &scheduledRun{Job: j, jobID: j.ID(), runID: uuid.New().String()}
+		rctx, rdone := jt.Context(r)
+		defer rdone()
+		runs, ctxs = append(runs, r), append(ctxs, rctx)
+	}
+	rt := &a.Dispatcher.retrier
+	rt.Attempt(runs[0])
+	if attempt, _ := rt.Attempt(runs[1]); attempt != 1 {
+		t.Errorf("Expected the second run's first attempt; Got %d", attempt)
+	}
+	rt.Done(runs[0])
+	rt.Done(runs[1])
+
+	if n := jt.Cancel(runs[0].ID()); n != 1 || ctxs[0].Err() == nil || ctxs[1].Err() != nil {
+		t.Errorf("Expected only the first run cancelled; Got %d %v %v", n, ctxs[0].Err(), ctxs[1].Err())
+	}
+	if n := jt.Cancel(j.ID()); n != 2 || ctxs[1].Err() == nil {
+		t.Errorf("Expected the job's runs cancelled; Got %d %v", n, ctxs[1].Err())
+	}
+
+	// A run past its deadline is marked as timed out
+	ctx, done = jt.Context(j)
+	defer done()
+	<-ctx.Done()
+	j.stopped(ctx)
+	if !j.Stats.RequestTimedOut {
+		t.Errorf("Expected RequestTimedOut to be set")
+	}
+}
+
+func TestPriorityQueues(t *testing.T) {
+	d := newTestDispatcher()
+
+	pq := &priorityQueues{}
+	pq.Init(d)
+
+	for _, c := range []string{priorityLow, priorityNormal, priorityHigh, ""} {
+		for i := 0; i < 10; i++ {
+			j := &logProcessorJob{PriorityClass: c}
+			j.Init()
+			pq.Push(j)
+		}
+	}
+	if n := d.MetricValue(dispatcherQueueDepth + priorityNormal); n != 20 {
+		t.Errorf("Expected normal queue depth 20; Got %d", n)
+	}
+
+	// Weights 6, 3, 1 share the first ten jobs
+	got := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		got[jobPriority(pq.Pop())]++
+	}
+	if got[priorityHigh] != 6 || got[priorityNormal] != 3 || got[priorityLow] != 1 {
+		t.Errorf("Expected 6 high, 3 normal, and 1 low; Got %v", got)
+	}
+
+	if n := len(pq.Drain()); n != 30 || pq.Pop() != nil {
+		t.Errorf("Expected 30 jobs drained and empty queues; Got %d", n)
+	}
+
+	js := jobSchedule{Priority: "urgent"}
+	if _, e := js.validate(); e == nil {
+		t.Errorf("Expected an error for priority urgent")
+	}
+}
+
+func TestTenantFairness(t *testing.T) {
+	d := newTestDispatcher()
+
+	pq := &priorityQueues{}
+	pq.Init(d)
+
+	// acme queues first but is limited to one job in flight
+	for _, tenant := range []string{"acme", "globex"} {
+		for i := 0; i < 3; i++ {
+			j := &logProcessorJob{}
+			j.Init()
+			j.Log.ID = tenant
+			if tenant == "acme" {
+				j.MaxInFlight = 1
+			}
+			pq.Push(j)
+		}
+	}
+
+	var order []string
+	var first Job
+	for j := pq.Pop(); j != nil; j = pq.Pop() {
+		if first == nil {
+			first = j
+		}
+		order = append(order, j.(*logProcessorJob).Log.ID)
+	}
+	if er := "acme globex globex globex"; strings.Join(order, " ") != er {
+		t.Errorf("Expected %s; Got %v", er, order)
+	}
+	if n := d.metrics.TenantsInFlight["globex"]; n != 3 {
+		t.Errorf("Expected 3 globex jobs in flight; Got %d", n)
+	}
+
+	// Finishing acme's job lets the next one run
+	pq.Done(first)
+	if j := pq.Pop(); j == nil || j.(*logProcessorJob).Log.ID != "acme" {
+		t.Errorf("Expected an acme job after Done; Got %v", j)
+	}
+}
+
+func TestJobStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ws, err := newWALJobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var jobs []*logProcessorJob
+	for _, tenant := range []string{"acme", "globex", "initech"} {
+		j := &logProcessorJob{}
+		j.Init()
+		j.Log.ID = tenant
+		jobs = append(jobs, j)
+		if err := ws.Append(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ws.Ack(jobs[1].ID())
+	ws.Close()
+
+	// A restart sees the unacknowledged jobs in order
+	d := newTestDispatcher()
+	d.queues.Init(d)
+	d.jobStore, err = newWALJobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.replayJobs()
+
+	if n := d.MetricValue(dispatcherJobsReplayed); n != 2 {
+		t.Errorf("Expected 2 jobs replayed; Got %d", n)
+	}
+
+	var order []string
+	for j := d.queues.Pop(); j != nil; j = d.queues.Pop() {
+		order = append(order, j.(*logProcessorJob).Log.ID)
+		d.acknowledge(j)
+	}
+	if er := "acme initech"; strings.Join(order, " ") != er {
+		t.Errorf("Expected %s; Got %v", er, order)
+	}
+
+	if recs, _ := d.jobStore.Pending(); len(recs) != 0 {
+		t.Errorf("Expected no pending jobs; Got %d", len(recs))
+	}
+	d.jobStore.Close()
+}
+
+func TestJobRegistry(t *testing.T) {
+	j := &logProcessorJob{}
+	j.Init()
+	j.Log.ID = "acme"
+
+	r, _ := (&logResult{}).LogErrorResults(j, errors.New("boom"))
+	decoded, err := r.Decode()
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if lp, ok := decoded.(*logProcessorJob); !ok || lp.ID() != j.ID() || lp.Log.ID != "acme" {
+		t.Errorf("Expected job %v for acme; Got %+v", j.ID(), decoded)
+	}
+
+	_, err = (&logResult{jobType: "io.pavedroad.unknown"}).Decode()
+	if !errors.Is(err, errUnknownJobType) {
+		t.Errorf("Expected %v; Got %v", errUnknownJobType, err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected registering %v twice to panic", LogQueueJobType)
+		}
+	}()
+	RegisterJobType(LogQueueJobType, func() Job { return &logQueueJob{} })
+}
+
+func TestCreateJobSpec(t *testing.T) {
+	// The first run is years away so the test doesn't start a sweep
+	spec := `{"type": "` + LogQueueJobType + `", "cron_expression": "0 0 29 feb *",
+		"params": {"customer_id": "` + uuid.New().String() + `", "bucket": "logs", "prefix": "2021/"}}`
+
+	req, _ := http.NewRequest("POST", JobURL, strings.NewReader(spec))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var created listJobsResponse
+	if err := json.Unmarshal(response.Body.Bytes(), &created); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if created.ID == "" || created.NextRunTime == nil || !strings.Contains(string(created.Params), "2021/") {
+		t.Errorf("Expected an ID, next run time, and params; Got %s", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("DELETE", JobURL+"/"+created.ID, nil)
+	executeRequest(req)
+
+	bad := []string{
+		`{"type": "io.pavedroad.unknown"}`,
+		`{"type": "` + LogQueueJobType + `", "params": {"customer_id": "acme"}}`,
+		`{"type": "` + LogQueueJobType + `", "params": {"bucket": 7}}`,
+		`{"type": "` + LogQueueJobType + `", "params": {"region": "us-west-1"}}`,
+		`{"type": "` + LogProcessorJobType + `", "params": {"Log": {"name": "2021/10/01.log"}}}`,
+	}
+	for _, b := range bad {
+		req, _ = http.NewRequest("POST", JobURL, strings.NewReader(b))
+		response = executeRequest(req)
+		checkResponseCode(t, http.StatusBadRequest, response.Code)
+	}
+
+	req, _ = http.NewRequest("GET", JobURL+"/types", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if !strings.Contains(response.Body.String(), "\"customer_id\"") {
+		t.Errorf("Expected the %s schema; Got %s", LogQueueJobType, response.Body.String())
+	}
+}
+
+func TestJobHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &eventScheduler{mux: &sync.Mutex{}}
+	s.history.Init(3, newDiskHistoryStore(dir))
+
+	// Scheduled runs record themselves, a download without a log fails
+	j := &logProcessorJob{}
+	j.Init()
+	run := func(ctx context.Context, name string) {
+		j.Log.Name = name
+		r := &scheduledRun{Job: j, s: s, jobID: j.ID(), runID: uuid.New().String()}
+		r.Run(ctx)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	for i := 0; i < 4; i++ {
+		run(ctx, "2021/10/01.log")
+	}
+	run(ctx, "")
+	cancel()
+	run(ctx, "2021/10/01.log")
+
+	// A new history reads the executions back from disk
+	h := jobHistory{}
+	h.Init(3, newDiskHistoryStore(dir))
+	rec := h.Get(j.ID())
+
+	var outcomes []string
+	for _, e := range rec.Executions {
+		outcomes = append(outcomes, e.Outcome)
+	}
+	if er := "succeeded failed cancelled"; strings.Join(outcomes, " ") != er {
+		t.Errorf("Expected %s; Got %v", er, outcomes)
+	}
+	if e := rec.Executions[1].Errors; len(e) != 1 || e[0].Message != errNoLog.Error() || e[0].Code != errCodeNoLog {
+		t.Errorf("Expected error %v; Got %v", errNoLog, e)
+	}
+	if !strings.Contains(string(rec.Metrics), "RequestTimedOut") {
+		t.Errorf("Expected job metrics; Got %s", rec.Metrics)
+	}
+}
+
+func TestRunJobNow(t *testing.T) {
+	// Disabled so only the runs started here are sent
+	spec := `{"type": "` + testJobType + `", "enabled": false, "params": {"name": "scheduled"}}`
+	req, _ := http.NewRequest("POST", JobURL, strings.NewReader(spec))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var created listJobsResponse
+	json.Unmarshal(response.Body.Bytes(), &created)
+	defer executeRequest(httptest.NewRequest("DELETE", JobURL+"/"+created.ID, nil))
+
+	req, _ = http.NewRequest("POST", JobURL+"/"+created.ID+"/run", strings.NewReader(`{"params": {"fail": "yes"}}`))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	req = httptest.NewRequest("POST", JobURL+"/"+uuid.New().String()+"/run", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	req, _ = http.NewRequest("POST", JobURL+"/"+created.ID+"/run", strings.NewReader(`{"params": {"name": "run-now"}}`))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusAccepted, response.Code)
+
+	var run runStatusResponse
+	json.Unmarshal(response.Body.Bytes(), &run)
+	if run.RunID == "" || run.Status != runQueued {
+		t.Fatalf("Expected a queued run; Got %s", response.Body.String())
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for run.Status == runQueued || run.Status == runRunning {
+		if time.Now().After(deadline) {
+			t.Fatalf("Run %v still %s", run.RunID, run.Status)
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		req, _ = http.NewRequest("GET", JobURL+"/"+created.ID+"/runs/"+run.RunID, nil)
+		response = executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		json.Unmarshal(response.Body.Bytes(), &run)
+	}
+
+	if run.Status != outcomeSucceeded || run.Execution == nil {
+		t.Errorf("Expected the run to succeed; Got %s", response.Body.String())
+	}
+
+	// The params given override the job's for this run
+	ran := strings.Join(testJobRan(), " ")
+	if !strings.Contains(ran, "run-now") || strings.Contains(ran, "scheduled") {
+		t.Errorf("Expected only run-now to run; Got %s", ran)
+	}
+}
+
+func TestJobFamilies(t *testing.T) {
+	d := newTestDispatcher()
+	d.stopForward = make(chan bool)
+	d.queues.Init(d)
+	d.families.Init(d)
+	d.families.maxQueued = 2
+
+	// A second worker is free to drain the queue
+	d.workers = []*worker{{}, {}}
+
+	parent := &logQueueJob{}
+	parent.Init()
+	s := &childSubmitter{d: d, parent: parent}
+
+	var children []Job
+	for i := 0; i < 3; i++ {
+		c := &logProcessorJob{}
+		c.Init()
+		children = append(children, c)
+	}
+	for _, c := range children[:2] {
+		if err := s.Submit(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Submit(children[2]); err != errSubmitBackpressure {
+		t.Errorf("Expected %v; Got %v", errSubmitBackpressure, err)
+	}
+
+	// With no free worker the limit would deadlock the parent
+	d.workers = d.workers[:1]
+	if err := s.Submit(children[2]); err != nil {
+		t.Errorf("Expected the child to be queued; Got %v", err)
+	}
+	d.families.finish(children[2], &logResult{}, false)
+
+	// The parent's result is held until its children finish
+	if out := d.families.finish(parent, &logResult{}, false); len(out) != 0 {
+		t.Errorf("Expected the parent to wait; Got %d results", len(out))
+	}
+	if out := d.families.finish(children[0], &logResult{}, true); len(out) != 1 {
+		t.Errorf("Expected 1 result; Got %d", len(out))
+	}
+	out := d.families.finish(children[1], &logResult{}, false)
+	if len(out) != 2 {
+		t.Fatalf("Expected the child's and parent's results; Got %d", len(out))
+	}
+
+	md := out[1].result.MetaData()
+	if md[metaDataChildren] != "3" || md[metaDataChildrenFailed] != "1" {
+		t.Errorf("Expected 3 children 1 failed; Got %v", md)
+	}
+	if out[1].job != parent || !out[1].failed {
+		t.Errorf("Expected the parent to fail with its child")
+	}
+
+	// A retried parent starts a new family, the first attempt's
+	// children finish on their own
+	d.queues.Drain()
+	if err := s.Submit(children[0]); err != nil {
+		t.Fatal(err)
+	}
+	d.families.retrying(parent)
+	if n := len(d.families.byParent) + len(d.families.byChild); n != 0 {
+		t.Errorf("Expected the family to be closed; Got %d entries", n)
+	}
+	if out := d.families.finish(parent, &logResult{}, false); len(out) != 1 || out[0].failed {
+		t.Errorf("Expected the retried parent to succeed at once; Got %v", out)
+	}
+}
+
+func TestWorkflows(t *testing.T) {
+	cycle := `{"steps": [
+		{"name": "a", "type": "` + testJobType + `", "on_success": ["b"]},
+		{"name": "b", "type": "` + testJobType + `", "on_success": ["a"]}]}`
+	req, _ := http.NewRequest("POST", WorkflowURL, strings.NewReader(cycle))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	// load succeeds and report fails, so only the failure edges
+	// after report run
+	step := func(name string, fail bool, onSuccess, onFailure string) string {
+		return fmt.Sprintf(`{"name": "%s", "type": "%s", "params": {"name": "wf-%s", "fail": %v},
+			"on_success": [%s], "on_failure": [%s]}`, name, testJobType, name, fail, onSuccess, onFailure)
+	}
+	spec := `{"name": "report", "steps": [` +
+		step("load", false, `"report"`, `"cleanup"`) + `,` +
+		step("report", true, `"publish"`, `"alert"`) + `,` +
+		step("cleanup", false, ``, ``) + `,` +
+		step("publish", false, ``, ``) + `,` +
+		step("alert", false, ``, ``) + `]}`
+	req, _ = http.NewRequest("POST", WorkflowURL, strings.NewReader(spec))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var wf workflowResponse
+	json.Unmarshal(response.Body.Bytes(), &wf)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for wf.Finished == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("Workflow %v still %s", wf.ID, wf.Status)
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		req, _ = http.NewRequest("GET", WorkflowURL+"/"+wf.ID, nil)
+		response = executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		json.Unmarshal(response.Body.Bytes(), &wf)
+	}
+
+	var states []string
+	for _, st := range wf.Steps {
+		states = append(states, st.Status)
+	}
+	if er := "succeeded failed skipped skipped succeeded"; wf.Status != outcomeFailed || strings.Join(states, " ") != er {
+		t.Errorf("Expected %s; Got %s", er, response.Body.String())
+	}
+
+	// Each step ran after its parent with the parent's payload
+	var ran []string
+	for _, p := range testJobRan() {
+		if strings.HasPrefix(p, "wf-") {
+			ran = append(ran, p)
+		}
+	}
+	if er := "wf-load wf-report<load:wf-load> wf-alert<report:wf-report<load:wf-load>>"; strings.Join(ran, " ") != er {
+		t.Errorf("Expected %s; Got %v", er, ran)
+	}
+
+	// Steps still running at shutdown are cancelled
+	d := newTestDispatcher()
+	d.stopForward = make(chan bool)
+	d.queues.Init(d)
+	d.workflows.Init(d)
+	run, err := newWorkflowRun(workflowSpec{Steps: []workflowStepSpec{
+		{Name: "load", Type: testJobType, OnSuccess: []string{"report"}},
+		{Name: "report", Type: testJobType},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.workflows.start(run)
+	close(d.stopForward)
+	d.workflows.cancelRunning()
+
+	states = nil
+	for _, st := range run.response().Steps {
+		states = append(states, st.Status)
+	}
+	if er := "cancelled skipped"; run.resp.Status != outcomeCancelled || strings.Join(states, " ") != er {
+		t.Errorf("Expected %s %s; Got %s %v", outcomeCancelled, er, run.resp.Status, states)
+	}
+
+	// Log downloads pass the log they processed on, a sweep that
+	// follows is limited to its customer and bucket
+	acme := "5a7c2d1e-3f4b-4c6d-8e9f-0a1b2c3d4e5f"
+	d = newTestDispatcher()
+	d.stopForward = make(chan bool)
+	d.queues.Init(d)
+	d.workflows.Init(d)
+	run, err = newWorkflowRun(workflowSpec{Steps: []workflowStepSpec{
+		{Name: "download", Type: LogProcessorJobType, OnSuccess: []string{"reprocess"},
+			Params: json.RawMessage(`{"Log": {"id": "` + acme + `", "bucket": "logs", "name": "2021/10/01.log", "location": "/tmp/01.log"}}`)},
+		{Name: "reprocess", Type: LogProcessorJobType, OnSuccess: []string{"sweep"}},
+		{Name: "sweep", Type: LogQueueJobType},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.workflows.start(run)
+	for _, st := range run.steps[:2] {
+		r, err := st.job.Run(context.Background())
+		d.workflows.finished(jobOutcome{job: st.job, result: r, failed: err != nil})
+	}
+
+	if lp := run.steps[1].job.(*logProcessorJob); lp.Log.Name != "2021/10/01.log" || lp.Log.ID != acme {
+		t.Errorf("Expected reprocess to get the downloaded log; Got %+v", lp.Log)
+	}
+	q := run.steps[2].job.(*logQueueJob)
+	if len(q.Inputs) != 1 || !q.inputMatches(acme, "logs") || q.inputMatches(acme, "other") || q.inputMatches("initech", "") {
+		t.Errorf("Expected the sweep limited to acme logs; Got %+v", q.Inputs)
+	}
+}
+
+func TestJobErrors(t *testing.T) {
+	j := &logProcessorJob{}
+	j.Init()
+	j.Log.LogFormat = s3.S3
+	j.Log.Name = "s3.log"
+	j.Log.Location = "/nonexistent/s3.log"
+
+	r, err := j.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := j.Errors(); len(errs) != 1 || !errors.Is(errs[0], s3.ErrParse) {
+		t.Errorf("Expected %v; Got %v", s3.ErrParse, errs)
+	}
+	if !strings.Contains(r.MetaData()["job_errors"], s3.ErrParse.Error()) {
+		t.Errorf("Expected the parse error in the result; Got %v", r.MetaData())
+	}
+
+	errs := resultErrors(r)
+	if len(errs) != 1 || errs[0].Code != errCodeParse || errs[0].Retryable || errs[0].Object != j.Log.Name {
+		t.Errorf("Expected a parse error that isn't retryable; Got %+v", errs)
+	}
+	if jobRetryable(j, r, jobFailed(j, r, nil)) {
+		t.Errorf("Expected a parse error not to be retried")
+	}
+
+	// One customer's errors don't fail a sweep of the others
+	q := &logQueueJob{}
+	q.Init()
+	q.jobErrors = []error{newJobError(fmt.Errorf("customer acme: %w", s3.ErrListObjects), "acme", "logs", "")}
+	pr, _ := (&logResult{}).LogPartialResults(q)
+	if e := jobFailed(q, pr, nil); e != nil || len(resultErrors(pr)) != 1 {
+		t.Errorf("Expected a partial success with 1 error; Got %v %v", e, pr.MetaData())
+	}
+	if e := newExecution("", nil, q, time.Now(), pr, nil); e.Outcome != outcomePartial || e.Errors[0].Customer != "acme" {
+		t.Errorf("Expected a partial execution for acme; Got %+v", e)
+	}
+}
+
+func TestJobErrorClassification(t *testing.T) {
+	tests := []struct {
+		err       error
+		code      string
+		retryable bool
+	}{
+		{fmt.Errorf("customer 1: %w", s3.ErrProviderNotFound), errCodeProviderNotFound, false},
+		{fmt.Errorf("bucket logs: %w", s3.ErrListObjects), errCodeListObjects, true},
+		{&webhookStatusError{status: http.StatusServiceUnavailable}, errCodeWebhook, true},
+		{&webhookStatusError{status: http.StatusNotFound}, errCodeWebhook, false},
+		{context.DeadlineExceeded, errCodeTimeout, true},
+		{context.Canceled, errCodeCancelled, false},
+		{errors.New("boom"), errCodeInternal, true},
+	}
+
+	for _, tc := range tests {
+		je := newJobError(tc.err, "", "", "")
+		if je.Code != tc.code || je.Retryable != tc.retryable {
+			t.Errorf("%v: Expected %s %v; Got %s %v", tc.err, tc.code, tc.retryable, je.Code, je.Retryable)
+		}
+		if !errors.Is(je, tc.err) {
+			t.Errorf("Expected %v to wrap %v", je, tc.err)
+		}
+	}
+}
+
+// panicJob indexes past the end of a slice like an unmatched log line
+type panicJob struct {
+	logProcessorJob
+}
+
+func (j *panicJob) Run(ctx context.Context) (Result, error) {
+	var match []string
+	return nil, errors.New(match[1])
+}
+
+func TestWorkerPanic(t *testing.T) {
+	d := newTestDispatcher()
+	w := &worker{id: 1, d: d}
+
+	j := &panicJob{}
+	j.Init()
+	r, err := w.runJob(context.Background(), j)
+	if !errors.Is(err, errJobPanicked) {
+		t.Fatalf("Expected %v; Got %v", errJobPanicked, err)
+	}
+	if r == nil || !strings.Contains(r.MetaData()[metaDataPanicStack], "panicJob") {
+		t.Errorf("Expected a stack trace in the result metadata")
+	}
+	if n := d.metrics.Counters[dispatcherJobPanics]; n != 1 {
+		t.Errorf("Expected 1 panic; Got %d", n)
+	}
+
+	// A worker that panics outside of a job gives back its tenant slot
+	d.ctx = context.Background()
+	d.queues.Init(d)
+	d.timeouts.Init(d)
+	tj := &typePanicJob{}
+	tj.Init()
+	tj.Log.ID = "acme"
+	d.queues.Push(tj)
+	w.jobChan = make(chan Job, 1)
+	w.jobChan <- d.queues.Pop()
+	if !w.runRecovered() {
+		t.Fatalf("Expected the worker to panic")
+	}
+	if n := d.metrics.TenantsInFlight["acme"]; n != 0 {
+		t.Errorf("Expected no acme jobs in flight; Got %d", n)
+	}
+}
+
+// typePanicJob panics when the worker looks up its timeout
+type typePanicJob struct {
+	logProcessorJob
+}
+
+func (j *typePanicJob) Type() string {
+	panic("no type")
+}
+
 func TestReady(t *testing.T) {
 
 	if !a.Ready {
@@ -336,8 +1350,9 @@ func TestJob(t *testing.T) {
 	response = executeRequest(req)
 	checkResponseCode(t, http.StatusCreated, response.Code)
 
-	if !strings.Contains(response.Body.String(), "success") {
-		t.Errorf("Create Job: expected success; Got false\n")
+	var created listJobsResponse
+	if e := json.Unmarshal(response.Body.Bytes(), &created); e != nil || created.ID == "" {
+		t.Errorf("Create Job: expected the new job; Got %s\n", response.Body.String())
 	}
 
 	// Update a job
@@ -351,9 +1366,8 @@ func TestJob(t *testing.T) {
 		t.Errorf("Update Job: expected success; Got false\n")
 	}
 
-	// Delete the job
-	// The update above results in new ID, so use the second record
-	req, _ = http.NewRequest("DELETE", JobURL+"/"+jl[1].ID, nil)
+	// Delete the job created above
+	req, _ = http.NewRequest("DELETE", JobURL+"/"+created.ID, nil)
 	response = executeRequest(req)
 	checkResponseCode(t, http.StatusOK, response.Code)
 
@@ -364,7 +1378,7 @@ func TestJob(t *testing.T) {
 }
 
 func TestManagementGet(t *testing.T) {
-	er := "{\"commands\":[{\"name\":\"set\",\"data_type\":\"int\",\"command_type\":\"config\",\"description\":\"Sets the value of a configurable field, see fields below\"},{\"name\":\"stop_scheduler\",\"data_type\":\"string\",\"command_type\":\"command\",\"description\":\"Stops the scheduler from send new jobs\"},{\"name\":\"start_scheduler\",\"data_type\":\"string\",\"command_type\":\"command\",\"description\":\"Starts the scheduler running again.  If running has no affect\"},{\"name\":\"stop_workers\",\"data_type\":\"string\",\"command_type\":\"command\",\"description\":\"Shutdown the worker pool letting jobs inflight complete\"},{\"name\":\"start_workers\",\"data_type\":\"string\",\"command_type\":\"command\",\"description\":\"Starts the worker pool if stopped\"},{\"name\":\"shutdown\",\"data_type\":\"string\",\"command_type\":\"command\",\"description\":\"Graceful shutdown\"},{\"name\":\"shutdown_now\",\"data_type\":\"string\",\"command_type\":\"command\",\"description\":\"Hard shutdown with SIGKILL\"}],\"fields\":[\"graceful_shutdown_seconds\",\"hard_shutdown_seconds\",\"number_of_workers\",\"scheduler_channel_size\",\"result_channel_size\"]}"
+	er := "{\"commands\":[{\"name\":\"set\",\"data_type\":\"int\",\"command_type\":\"config\",\"description\":\"Sets the value of a configurable field, see fields below\"},{\"name\":\"stop_scheduler\",\"data_type\":\"string\",\"command_type\":\"command\",\"description\":\"Stops the scheduler from send new jobs\"},{\"name\":\"start_scheduler\",\"data_type\":\"string\",\"command_type\":\"command\",\"description\":\"Starts the scheduler running again.  If running has no affect\"},{\"name\":\"stop_workers\",\"data_type\":\"string\",\"command_type\":\"command\",\"description\":\"Shutdown the worker pool letting jobs inflight complete\"},{\"name\":\"start_workers\",\"data_type\":\"string\",\"command_type\":\"command\",\"description\":\"Starts the worker pool if stopped\"},{\"name\":\"cancel_job\",\"data_type\":\"string\",\"command_type\":\"command\",\"description\":\"Cancels the running job with job_id\"},{\"name\":\"cancel_jobs\",\"data_type\":\"string\",\"command_type\":\"command\",\"description\":\"Cancels every running job\"},{\"name\":\"shutdown\",\"data_type\":\"string\",\"command_type\":\"command\",\"description\":\"Graceful shutdown\"},{\"name\":\"shutdown_now\",\"data_type\":\"string\",\"command_type\":\"command\",\"description\":\"Hard shutdown with SIGKILL\"},{\"name\":\"shutdown_status\",\"data_type\":\"string\",\"command_type\":\"command\",\"description\":\"Reports the progress of a shutdown\"}],\"fields\":[\"graceful_shutdown_seconds\",\"hard_shutdown_seconds\",\"number_of_workers\",\"scheduler_channel_size\",\"result_channel_size\",\"autoscale_enabled\",\"min_number_of_workers\",\"max_number_of_workers\",\"autoscale_backlog_high_percent\",\"autoscale_backlog_low_percent\",\"autoscale_latency_high_ms\",\"autoscale_cooldown_seconds\",\"retry_initial_backoff_ms\",\"retry_max_backoff_ms\",\"retry_max_attempts:io.pavedraod.eventbridge.logQueueJob\",\"retry_max_attempts:io.pavedraod.eventbridge.logprocessorjob\",\"job_timeout_seconds:io.pavedraod.eventbridge.logQueueJob\",\"job_timeout_seconds:io.pavedraod.eventbridge.logprocessorjob\",\"priority_weight:high\",\"priority_weight:normal\",\"priority_weight:low\",\"tenant_max_in_flight\",\"max_queued_jobs\"]}"
 
 	req, _ := http.NewRequest("GET", ManagementURL, nil)
 	response := executeRequest(req)
@@ -387,10 +1401,10 @@ func TestManagementPutSafe(t *testing.T) {
 	tc["set_hard_shutdown_seconds"] = "{\"command\": \"set\", \"field\": \"hard_shutdown_seconds\", \"field_value\": 5}"
 	tc["number_of_workers"] = "{\"command\": \"set\", \"field\": \"number_of_workers\", \"field_value\": 10}"
 	tc["set_hard_shutdown_seconds0"] = "{\"command\": \"set\", \"field\": \"hard_shutdown_seconds\", \"field_value\": 0}"
+	tc["shutdown_status"] = "{\"command\": \"shutdown_status\", \"field\": \"\", \"field_value\": 0}"
 	tc["bad_command"] = "{\"command\": \"foobar\", \"field\": \"hard_shutdown_seconds\", \"field_value\": 0}"
 	tc["bad_json"] = "{\"command\": foobar, \"field\": \"hard_shutdown_seconds\", \"field_value\": 0}"
 
-	// TODO: These are not implemented in dispatcher yet
 	tc["scheduler_channel_size"] = "{\"command\": \"set\", \"field\": \"scheduler_channel_size\", \"field_value\": 10}"
 	tc["result_channel_size"] = "{\"command\": \"set\", \"field\": \"result_channel_size\", \"field_value\": 10}"
 
@@ -398,10 +1412,24 @@ func TestManagementPutSafe(t *testing.T) {
 	response := executeRequest(req)
 	checkResponseCode(t, http.StatusOK, response.Code)
 
+	// The scheduler reports it is paused
+	req, _ = http.NewRequest("GET", ScheduleURL, nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	er := "\"scheduler_paused\":true"
+	if body := response.Body.String(); !strings.Contains(body, er) {
+		t.Errorf("Expected %s. Got %s", er, body)
+	}
+
 	req, _ = http.NewRequest("PUT", ManagementURL, strings.NewReader(tc["start_scheduler"]))
 	response = executeRequest(req)
 	checkResponseCode(t, http.StatusOK, response.Code)
 
+	st := a.Scheduler.Status()
+	if st.SchedulerPaused || !st.SchedulerRunning || !st.ResultCollectorRunning {
+		t.Errorf("Expected scheduler running. Got %+v", st)
+	}
+
 	req, _ = http.NewRequest("PUT", ManagementURL, strings.NewReader(tc["stop_workers"]))
 	response = executeRequest(req)
 	checkResponseCode(t, http.StatusOK, response.Code)
@@ -415,7 +1443,7 @@ func TestManagementPutSafe(t *testing.T) {
 	response = executeRequest(req)
 	checkResponseCode(t, http.StatusBadRequest, response.Code)
 
-	er := "{\"Status\": \"5 already running\"}"
+	er = "{\"Status\": \"5 already running\"}"
 	if body := response.Body.String(); body != er {
 		t.Errorf("Expected %s. Got %s", er, body)
 	}
@@ -437,6 +1465,34 @@ func TestManagementPutSafe(t *testing.T) {
 		t.Errorf("Expected %s. Got %s", er, body)
 	}
 
+	req, _ = http.NewRequest("PUT", ManagementURL, strings.NewReader(tc["number_of_workers"]))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	er = "{\"Status\": \"number_of_workers changed from 5 to 10\"}"
+	if body := response.Body.String(); body != er {
+		t.Errorf("Expected %s. Got %s", er, body)
+	}
+
+	if active := a.Dispatcher.activeWorkers(); active != 10 {
+		t.Errorf("Expected 10 active workers. Got %d", active)
+	}
+
+	req, _ = http.NewRequest("PUT", ManagementURL, strings.NewReader(tc["scheduler_channel_size"]))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	er = "{\"Status\": \"scheduler_channel_size changed from 5 to 10\"}"
+	if body := response.Body.String(); body != er {
+		t.Errorf("Expected %s. Got %s", er, body)
+	}
+
+	req, _ = http.NewRequest("PUT", ManagementURL, strings.NewReader(tc["result_channel_size"]))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	er = "{\"Status\": \"result_channel_size changed from 5 to 10\"}"
+	if body := response.Body.String(); body != er {
+		t.Errorf("Expected %s. Got %s", er, body)
+	}
+
 	// Set it back to 0 so we exit tests quickly
 	req, _ = http.NewRequest("PUT", ManagementURL, strings.NewReader(tc["set_hard_shutdown_seconds0"]))
 	response = executeRequest(req)
@@ -461,6 +1517,42 @@ func TestManagementPutSafe(t *testing.T) {
 	if body := response.Body.String(); body != er {
 		t.Errorf("Expected %s. Got %s", er, body)
 	}
+
+	// Shutdowns run in the background, clients poll shutdown_status
+	req, _ = http.NewRequest("PUT", ManagementURL, strings.NewReader(tc["shutdown_status"]))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	er = "{\"Status\": \"Not shutting down\"}"
+	if body := response.Body.String(); body != er {
+		t.Errorf("Expected %s. Got %s", er, body)
+	}
+
+	d := newTestDispatcher()
+	d.shuttingDown = true
+	d.shutdownDone = make(chan bool)
+	if status, body, _ := d.ProcessManagementRequest(managementRequest{Command: "shutdown"}); status != http.StatusAccepted {
+		t.Errorf("Expected %d for a shutdown in progress. Got %d %s", http.StatusAccepted, status, body)
+	}
+
+	d.shutdownSummary = shutdownSummary{JobsCompleted: 2, JobsAbandoned: 1}
+	close(d.shutdownDone)
+	status, body, _ := d.ProcessManagementRequest(managementRequest{Command: "shutdown_status"})
+	er = "{\"Status\": \"Shutdown complete\", \"jobs_completed\": 2, \"jobs_abandoned\": 1, \"timed_out\": false}"
+	if status != http.StatusOK || string(body) != er {
+		t.Errorf("Expected %d %s. Got %d %s", http.StatusOK, er, status, body)
+	}
+}
+
+// newTestDispatcher returns a dispatcher with the metrics and lock
+// its components use, tests initialize the components they need
+func newTestDispatcher() *dispatcher {
+	d := &dispatcher{}
+	d.metrics.Counters = make(map[string]int)
+	d.metrics.TenantsInFlight = make(map[string]int)
+	d.metrics.mux = &sync.Mutex{}
+	d.mux = &sync.Mutex{}
+	return d
 }
 
 func executeRequest(req *http.Request) *httptest.ResponseRecorder {
@@ -20,3 +20,5 @@ require (
 	go.uber.org/zap v1.19.1 // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0 // indirect
 )
+
+replace github.com/pavedroad-io/eventbridge/s3 => ./s3
@@ -171,3 +171,123 @@ func deleteSchedulePreHook(w http.ResponseWriter, r *http.Request, key string) {
 func deleteSchedulePostHook(w http.ResponseWriter, r *http.Request, key string) {
 	return
 }
+
+// listDeadLettersPreHook
+//
+func listDeadLettersPreHook(w http.ResponseWriter, r *http.Request) {
+	return
+}
+
+// listDeadLettersPostHook
+//
+func listDeadLettersPostHook(w http.ResponseWriter, r *http.Request) {
+	return
+}
+
+// getDeadLetterPreHook
+//
+func getDeadLetterPreHook(w http.ResponseWriter, r *http.Request, key string) {
+	return
+}
+
+// getDeadLetterPostHook
+//
+func getDeadLetterPostHook(w http.ResponseWriter, r *http.Request, key string) {
+	return
+}
+
+// replayDeadLetterPreHook
+//
+func replayDeadLetterPreHook(w http.ResponseWriter, r *http.Request, key string) {
+	return
+}
+
+// replayDeadLetterPostHook
+//
+func replayDeadLetterPostHook(w http.ResponseWriter, r *http.Request, key string) {
+	return
+}
+
+// purgeDeadLettersPreHook
+//
+func purgeDeadLettersPreHook(w http.ResponseWriter, r *http.Request, key string) {
+	return
+}
+
+// purgeDeadLettersPostHook
+//
+func purgeDeadLettersPostHook(w http.ResponseWriter, r *http.Request, key string) {
+	return
+}
+
+// listJobTypesPreHook
+//
+func listJobTypesPreHook(w http.ResponseWriter, r *http.Request) {
+	return
+}
+
+// listJobTypesPostHook
+//
+func listJobTypesPostHook(w http.ResponseWriter, r *http.Request) {
+	return
+}
+
+// runJobPreHook
+//
+func runJobPreHook(w http.ResponseWriter, r *http.Request, key string) {
+	return
+}
+
+// runJobPostHook
+//
+func runJobPostHook(w http.ResponseWriter, r *http.Request, key string) {
+	return
+}
+
+// getJobRunPreHook
+//
+func getJobRunPreHook(w http.ResponseWriter, r *http.Request, key, run string) {
+	return
+}
+
+// getJobRunPostHook
+//
+func getJobRunPostHook(w http.ResponseWriter, r *http.Request, key, run string) {
+	return
+}
+
+// createWorkflowPreHook
+//
+func createWorkflowPreHook(w http.ResponseWriter, r *http.Request) {
+	return
+}
+
+// createWorkflowPostHook
+//
+func createWorkflowPostHook(w http.ResponseWriter, r *http.Request) {
+	return
+}
+
+// listWorkflowsPreHook
+//
+func listWorkflowsPreHook(w http.ResponseWriter, r *http.Request) {
+	return
+}
+
+// listWorkflowsPostHook
+//
+func listWorkflowsPostHook(w http.ResponseWriter, r *http.Request) {
+	return
+}
+
+// getWorkflowPreHook
+//
+func getWorkflowPreHook(w http.ResponseWriter, r *http.Request, key string) {
+	return
+}
+
+// getWorkflowPostHook
+//
+func getWorkflowPostHook(w http.ResponseWriter, r *http.Request, key string) {
+	return
+}
@@ -0,0 +1,215 @@
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root
+// for full license information.
+//
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pavedroad-io/eventbridge/s3"
+)
+
+// Error codes
+const (
+	errCodeCustomerLoad     = "customer_load"
+	errCodeProviderNotFound = "provider_not_found"
+	errCodeClientCreate     = "client_create"
+	errCodeListObjects      = "list_objects"
+	errCodeObjectDownload   = "object_download"
+	errCodeParse            = "parse"
+	errCodeWebhook          = "webhook"
+	errCodeTimeout          = "timeout"
+	errCodeCancelled        = "cancelled"
+	errCodePanic            = "panic"
+	errCodeChildren         = "children_failed"
+	errCodeBackpressure     = "backpressure"
+	errCodeNoLog            = "no_log"
+	errCodeInternal         = "internal"
+)
+
+// Metrics constants
+const (
+	dispatcherNotRetryable = "job_not_retryable"
+	resultsRetryable       = "results_failed_retryable"
+	resultsPermanent       = "results_failed_permanent"
+	resultsPartial         = "results_partial"
+)
+
+// Result metadata keys
+const (
+	metaDataJobErrors = "job_errors"
+	metaDataRetryable = "retryable"
+	metaDataPartial   = "partial"
+)
+
+// JobError is an error a job recorded with what it was working on
+// and whether running the job again could succeed
+type JobError struct {
+	Code      string    `json:"code"`
+	Message   string    `json:"message"`
+	Retryable bool      `json:"retryable"`
+	Customer  string    `json:"customer,omitempty"`
+	Bucket    string    `json:"bucket,omitempty"`
+	Object    string    `json:"object,omitempty"`
+	Time      time.Time `json:"time"`
+	err       error
+}
+
+// newJobError classifies err, customer, bucket, and object are
+// empty if they don't apply
+func newJobError(err error, customer, bucket, object string) *JobError {
+	code, retryable := classifyError(err)
+	return &JobError{
+		Code:      code,
+		Message:   err.Error(),
+		Retryable: retryable,
+		Customer:  customer,
+		Bucket:    bucket,
+		Object:    object,
+		Time:      time.Now(),
+		err:       err,
+	}
+}
+
+func (e *JobError) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the error e was created from, nil once decoded
+func (e *JobError) Unwrap() error {
+	return e.err
+}
+
+// UnmarshalJSON also reads the plain messages history used to keep
+func (e *JobError) UnmarshalJSON(data []byte) error {
+	var msg string
+	if err := json.Unmarshal(data, &msg); err == nil {
+		*e = JobError{Code: errCodeInternal, Message: msg}
+		return nil
+	}
+
+	type plain JobError
+	return json.Unmarshal(data, (*plain)(e))
+}
+
+// webhookStatusError a webhook answered with a status other than 200
+type webhookStatusError struct {
+	status int
+}
+
+func (e *webhookStatusError) Error() string {
+	return fmt.Sprintf("HTTP POST failed non 200 %v", e.status)
+}
+
+// classifyError returns the code for err and whether the job could
+// succeed if it ran again
+func classifyError(err error) (code string, retryable bool) {
+	var se *webhookStatusError
+	var ue *url.Error
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return errCodeTimeout, true
+	case errors.Is(err, context.Canceled):
+		return errCodeCancelled, false
+	case errors.Is(err, s3.ErrCustomerLoad):
+		return errCodeCustomerLoad, false
+	case errors.Is(err, s3.ErrProviderNotFound):
+		return errCodeProviderNotFound, false
+	case errors.Is(err, s3.ErrClientCreate):
+		return errCodeClientCreate, false
+	case errors.Is(err, s3.ErrListObjects):
+		return errCodeListObjects, true
+	case errors.Is(err, s3.ErrObjectDownload):
+		return errCodeObjectDownload, true
+	case errors.Is(err, s3.ErrParse):
+		return errCodeParse, false
+	case errors.Is(err, errJobPanicked):
+		return errCodePanic, true
+	case errors.Is(err, errSubmitBackpressure):
+		return errCodeBackpressure, true
+	case errors.Is(err, errNoLog):
+		return errCodeNoLog, false
+	case errors.As(err, &se):
+		return errCodeWebhook, se.status >= http.StatusInternalServerError ||
+			se.status == http.StatusTooManyRequests
+	case errors.As(err, &ue):
+		// A webhook URL that doesn't parse won't on the next run
+		return errCodeWebhook, ue.Op != "parse"
+	}
+	return errCodeInternal, true
+}
+
+// asJobError returns err as a JobError, classifying errors jobs
+// didn't record themselves
+func asJobError(err error) *JobError {
+	var je *JobError
+	if errors.As(err, &je) {
+		return je
+	}
+	return newJobError(err, "", "", "")
+}
+
+// collectErrors returns the errors j recorded, or cause if it
+// recorded none
+func collectErrors(j Job, cause error) []JobError {
+	var errs []JobError
+	for _, e := range j.Errors() {
+		errs = append(errs, *asJobError(e))
+	}
+	if len(errs) == 0 && cause != nil {
+		errs = append(errs, *asJobError(cause))
+	}
+	return errs
+}
+
+// resultErrors returns the errors LogErrorResults recorded on r
+func resultErrors(r Result) []JobError {
+	if r == nil {
+		return nil
+	}
+	md, ok := r.MetaData()[metaDataJobErrors]
+	if !ok {
+		return nil
+	}
+
+	var errs []JobError
+	if err := json.Unmarshal([]byte(md), &errs); err != nil {
+		return nil
+	}
+	return errs
+}
+
+// partialResult is true for a result built by LogPartialResults
+func partialResult(r Result) bool {
+	return r != nil && r.MetaData()[metaDataPartial] == "true"
+}
+
+// retryable is true if any of errs could succeed on another run
+func retryable(errs []JobError) bool {
+	for _, e := range errs {
+		if e.Retryable {
+			return true
+		}
+	}
+	return false
+}
+
+// addErrorMetaData records errs and whether they are retryable on r
+func addErrorMetaData(r Result, errs []JobError) {
+	if len(errs) == 0 {
+		return
+	}
+	if jb, err := json.Marshal(errs); err == nil {
+		r.AddMetaData(metaDataJobErrors, string(jb))
+	}
+	r.AddMetaData(metaDataRetryable, strconv.FormatBool(retryable(errs)))
+}
@@ -0,0 +1,343 @@
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root
+// for full license information.
+//
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// MaxQueuedJobs queued jobs at which Submit pushes back, 0 is unlimited
+const MaxQueuedJobs int = 10000
+
+// Management API
+const maxQueuedJobs string = "max_queued_jobs"
+
+// Metrics constants
+const (
+	dispatcherChildrenSubmitted  = "children_submitted"
+	dispatcherSubmitBackpressure = "submit_backpressure"
+	dispatcherParentsWaiting     = "parents_waiting"
+)
+
+// Result metadata set on parents once their children finish
+const (
+	metaDataChildren          = "children"
+	metaDataChildrenFailed    = "children_failed"
+	metaDataChildrenAbandoned = "children_abandoned"
+)
+
+var (
+	errSubmitBackpressure = errors.New("job queue full, try again")
+	errDispatcherStopped  = errors.New("dispatcher is shutting down")
+)
+
+// JobSubmitter sends jobs created by a running job to the workers
+// without blocking the worker running it
+type JobSubmitter interface {
+	// Submit queues child or returns errSubmitBackpressure if
+	// the queue is full
+	Submit(child Job) error
+}
+
+// childWaiter is implemented by jobs that report their own
+// completion, they are told once their children finish
+type childWaiter interface {
+	childrenDone(total, failed int)
+}
+
+type submitterKey struct{}
+
+// childSubmitter submits children of parent
+type childSubmitter struct {
+	d      *dispatcher
+	parent Job
+}
+
+// Submit queues child as a child of cs.parent
+func (cs *childSubmitter) Submit(child Job) error {
+	return cs.d.submitChild(cs.parent, child)
+}
+
+// children returns how many children cs.parent submitted
+func (cs *childSubmitter) children() int {
+	cs.d.families.mux.Lock()
+	defer cs.d.families.mux.Unlock()
+
+	if f, ok := cs.d.families.byParent[cs.parent]; ok {
+		return f.total
+	}
+	return 0
+}
+
+// withSubmitter returns ctx carrying a submitter for parent
+func withSubmitter(ctx context.Context, d *dispatcher, parent Job) context.Context {
+	return context.WithValue(ctx, submitterKey{}, &childSubmitter{d: d, parent: parent})
+}
+
+// SubmitterFromContext returns the submitter for the running job,
+// nil if it isn't run by a dispatcher
+func SubmitterFromContext(ctx context.Context) JobSubmitter {
+	s, _ := ctx.Value(submitterKey{}).(JobSubmitter)
+	return s
+}
+
+// jobOutcome is the result of a job's final attempt, a parent
+// failed if it or any of its children did
+type jobOutcome struct {
+	job    Job
+	result Result
+	failed bool
+}
+
+// jobFamily is a parent and the children it submitted
+type jobFamily struct {
+	parent       Job
+	children     []string // IDs of the children submitted
+	total        int
+	pending      int
+	failed       int
+	done         bool   // the parent has finished
+	parentFailed bool   // set when done
+	result       Result // the parent's, held until pending is 0
+}
+
+// annotate records how the children did on the parent's result
+func (f *jobFamily) annotate() {
+	f.result.AddMetaData(metaDataChildren, strconv.Itoa(f.total))
+	f.result.AddMetaData(metaDataChildrenFailed, strconv.Itoa(f.failed))
+}
+
+// outcome returns the parent's outcome once its children are done
+func (f *jobFamily) outcome() jobOutcome {
+	return jobOutcome{job: f.parent, result: f.result, failed: f.parentFailed || f.failed > 0}
+}
+
+// notify tells the parent its children are done, call it
+// without holding jobFamilies.mux
+func (f *jobFamily) notify() {
+	if cw, ok := f.parent.(childWaiter); ok {
+		cw.childrenDone(f.total, f.failed)
+	}
+}
+
+// jobFamilies tracks parents until all of their children finish
+type jobFamilies struct {
+	d         *dispatcher
+	byParent  map[Job]*jobFamily
+	byChild   map[string]*jobFamily
+	maxQueued int
+	mux       *sync.Mutex
+}
+
+// Init sets defaults
+func (jf *jobFamilies) Init(d *dispatcher) {
+	jf.d = d
+	jf.mux = &sync.Mutex{}
+	jf.maxQueued = MaxQueuedJobs
+	jf.byParent = make(map[Job]*jobFamily)
+	jf.byChild = make(map[string]*jobFamily)
+}
+
+// Fields returns the management fields jobFamilies handles
+func (jf *jobFamilies) Fields() []string {
+	return []string{maxQueuedJobs}
+}
+
+// Handles is true for fields SetConfigVariable accepts
+func (jf *jobFamilies) Handles(name string) bool {
+	return name == maxQueuedJobs
+}
+
+// SetConfigVariable changes the queue size Submit pushes back at
+func (jf *jobFamilies) SetConfigVariable(name string, value int) (msg []byte, err error) {
+	var rmsg string
+
+	if value < 0 {
+		rmsg = fmt.Sprintf("{\"Status\": \"%s must be 0 or more\"}", name)
+		return []byte(rmsg), errors.New("invalid queue size")
+	}
+
+	jf.mux.Lock()
+	old := jf.maxQueued
+	jf.maxQueued = value
+	jf.mux.Unlock()
+
+	rmsg = fmt.Sprintf("{\"Status\": \"%s changed from %d to %d\"}",
+		name, old, value)
+	return []byte(rmsg), nil
+}
+
+// submitting registers parent as a job producing children and
+// returns the queue limit and how many parents are still running
+func (jf *jobFamilies) submitting(parent Job) (maxQueued, running int) {
+	jf.mux.Lock()
+	defer jf.mux.Unlock()
+
+	if _, ok := jf.byParent[parent]; !ok {
+		jf.byParent[parent] = &jobFamily{parent: parent}
+	}
+	for _, f := range jf.byParent {
+		if !f.done {
+			running++
+		}
+	}
+	return jf.maxQueued, running
+}
+
+// add records child as a child of parent
+func (jf *jobFamilies) add(parent, child Job) {
+	jf.mux.Lock()
+	defer jf.mux.Unlock()
+
+	f := jf.byParent[parent]
+	f.total++
+	f.pending++
+	f.children = append(f.children, child.ID())
+	jf.byChild[child.ID()] = f
+}
+
+// retrying closes the family of parent before it runs again.  The
+// children it submitted finish on their own, the next attempt
+// starts a new family.
+func (jf *jobFamilies) retrying(parent Job) {
+	jf.mux.Lock()
+	defer jf.mux.Unlock()
+
+	f, ok := jf.byParent[parent]
+	if !ok {
+		return
+	}
+	delete(jf.byParent, parent)
+	for _, id := range f.children {
+		if jf.byChild[id] == f {
+			delete(jf.byChild, id)
+		}
+	}
+	jf.d.MetricSet(dispatcherParentsWaiting, jf.waiting())
+}
+
+// finish is called with the result of j's final attempt.  It returns
+// the outcomes to forward now, none if j is waiting on children, and
+// the held outcomes of parents whose last child was j.
+func (jf *jobFamilies) finish(j Job, r Result, failed bool) []jobOutcome {
+	var completed []*jobFamily
+	defer func() {
+		for _, f := range completed {
+			f.notify()
+		}
+	}()
+
+	jf.mux.Lock()
+	defer jf.mux.Unlock()
+
+	if f, ok := jf.byParent[j]; ok {
+		f.done = true
+		f.parentFailed = failed
+		f.result = r
+		if f.pending > 0 {
+			jf.d.MetricSet(dispatcherParentsWaiting, jf.waiting())
+			return nil
+		}
+		delete(jf.byParent, j)
+		f.annotate()
+		completed = append(completed, f)
+		failed = f.outcome().failed
+	}
+	out := []jobOutcome{{job: j, result: r, failed: failed}}
+
+	// A finished child may complete its parent, which may in
+	// turn complete its own parent
+	for {
+		f, ok := jf.byChild[j.ID()]
+		if !ok {
+			break
+		}
+		delete(jf.byChild, j.ID())
+
+		f.pending--
+		if failed {
+			f.failed++
+		}
+		if f.pending > 0 || !f.done {
+			break
+		}
+
+		delete(jf.byParent, f.parent)
+		f.annotate()
+		completed = append(completed, f)
+		o := f.outcome()
+		out = append(out, o)
+		j, failed = o.job, o.failed
+	}
+
+	jf.d.MetricSet(dispatcherParentsWaiting, jf.waiting())
+	return out
+}
+
+// waiting counts parents held for children, the caller holds jf.mux
+func (jf *jobFamilies) waiting() int {
+	n := 0
+	for _, f := range jf.byParent {
+		if f.done {
+			n++
+		}
+	}
+	return n
+}
+
+// release returns the outcomes of parents still waiting on children
+// that won't finish, used by shutdown
+func (jf *jobFamilies) release() []jobOutcome {
+	var completed []*jobFamily
+	defer func() {
+		for _, f := range completed {
+			f.notify()
+		}
+	}()
+
+	jf.mux.Lock()
+	defer jf.mux.Unlock()
+
+	var out []jobOutcome
+	for p, f := range jf.byParent {
+		if f.done {
+			f.annotate()
+			f.result.AddMetaData(metaDataChildrenAbandoned, strconv.Itoa(f.pending))
+			completed = append(completed, f)
+			out = append(out, f.outcome())
+		}
+		delete(jf.byParent, p)
+	}
+	jf.byChild = make(map[string]*jobFamily)
+	jf.d.MetricSet(dispatcherParentsWaiting, 0)
+	return out
+}
+
+// submitChild queues child without blocking, on errSubmitBackpressure
+// the caller leaves the rest of its work for a later run.  Once every
+// worker is running a parent nothing would drain the queue, so the
+// limit is ignored.
+func (d *dispatcher) submitChild(parent, child Job) error {
+	select {
+	case <-d.stopForward:
+		return errDispatcherStopped
+	default:
+	}
+
+	max, running := d.families.submitting(parent)
+	if max > 0 && d.queues.Len() >= max && running < d.activeWorkers() {
+		d.MetricInc(dispatcherSubmitBackpressure)
+		return errSubmitBackpressure
+	}
+
+	d.families.add(parent, child)
+	d.MetricInc(dispatcherChildrenSubmitted)
+	d.enqueue(child)
+	return nil
+}
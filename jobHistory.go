@@ -0,0 +1,301 @@
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root
+// for full license information.
+//
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// JobHistorySize executions kept for each job, setting
+// EB_JOB_HISTORY_DIR also keeps them on disk
+const JobHistorySize int = 20
+
+// Execution outcomes
+const (
+	outcomeSucceeded = "succeeded"
+	outcomeFailed    = "failed"
+	outcomeTimedOut  = "timed_out"
+	outcomeCancelled = "cancelled"
+	outcomePartial   = "partial"
+)
+
+var errHistoryNotFound = errors.New("job history not found")
+
+// jobExecution is one run of a scheduled job
+type jobExecution struct {
+	RunID      string     `json:"run_id,omitempty"`
+	Start      time.Time  `json:"start"`
+	DurationMS int64      `json:"duration_ms"`
+	Outcome    string     `json:"outcome"`
+	Errors     []JobError `json:"errors,omitempty"`
+}
+
+// jobRecord is the history kept for one job
+type jobRecord struct {
+	// Executions oldest first
+	Executions []jobExecution `json:"executions"`
+
+	// Metrics from the latest execution
+	Metrics json.RawMessage `json:"metrics,omitempty"`
+}
+
+// executionRing holds the latest executions of a job
+type executionRing struct {
+	runs    []jobExecution
+	next    int // slot the next execution is written to once full
+	metrics json.RawMessage
+}
+
+// add records e dropping the oldest execution if there are size
+func (er *executionRing) add(e jobExecution, size int) {
+	if len(er.runs) < size {
+		er.runs = append(er.runs, e)
+		return
+	}
+	er.runs[er.next] = e
+	er.next = (er.next + 1) % size
+}
+
+// record returns the executions oldest first
+func (er *executionRing) record() jobRecord {
+	rec := jobRecord{Executions: make([]jobExecution, 0, len(er.runs)), Metrics: er.metrics}
+	rec.Executions = append(rec.Executions, er.runs[er.next:]...)
+	rec.Executions = append(rec.Executions, er.runs[:er.next]...)
+	return rec
+}
+
+// historyStore persists job history, implement it to keep
+// history somewhere other than local disk
+type historyStore interface {
+	Save(jobID string, rec jobRecord) error
+	Load(jobID string) (jobRecord, error)
+	Delete(jobID string) error
+}
+
+// diskHistoryStore writes one JSON file per job
+type diskHistoryStore struct {
+	dir string
+	mux *sync.Mutex
+}
+
+// newDiskHistoryStore returns a store using dir
+func newDiskHistoryStore(dir string) *diskHistoryStore {
+	return &diskHistoryStore{dir: dir, mux: &sync.Mutex{}}
+}
+
+// path returns the file for jobID, which must be a UUID
+func (hs *diskHistoryStore) path(jobID string) (string, error) {
+	if _, err := uuid.Parse(jobID); err != nil {
+		return "", errHistoryNotFound
+	}
+	return filepath.Join(hs.dir, jobID+".json"), nil
+}
+
+// Save writes rec replacing the job's earlier history
+func (hs *diskHistoryStore) Save(jobID string, rec jobRecord) error {
+	fn, err := hs.path(jobID)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	hs.mux.Lock()
+	defer hs.mux.Unlock()
+
+	if err := os.MkdirAll(hs.dir, 0755); err != nil {
+		return err
+	}
+
+	tmp := fn + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+// Load reads the job's history
+func (hs *diskHistoryStore) Load(jobID string) (jobRecord, error) {
+	rec := jobRecord{}
+
+	fn, err := hs.path(jobID)
+	if err != nil {
+		return rec, err
+	}
+
+	hs.mux.Lock()
+	defer hs.mux.Unlock()
+
+	data, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return rec, errHistoryNotFound
+	} else if err != nil {
+		return rec, err
+	}
+
+	err = json.Unmarshal(data, &rec)
+	return rec, err
+}
+
+// Delete removes the job's history
+func (hs *diskHistoryStore) Delete(jobID string) error {
+	fn, err := hs.path(jobID)
+	if err != nil {
+		return err
+	}
+
+	hs.mux.Lock()
+	defer hs.mux.Unlock()
+
+	if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// jobHistory keeps the latest executions of each scheduled job
+type jobHistory struct {
+	size  int
+	rings map[string]*executionRing
+	store historyStore // nil unless EB_JOB_HISTORY_DIR is set
+	mux   *sync.Mutex
+}
+
+// Init sets defaults
+func (h *jobHistory) Init(size int, store historyStore) {
+	h.size = size
+	h.store = store
+	h.rings = make(map[string]*executionRing)
+	h.mux = &sync.Mutex{}
+}
+
+// ring returns the ring for id loading it from the store the
+// first time, the caller holds h.mux
+func (h *jobHistory) ring(id string) *executionRing {
+	if er, ok := h.rings[id]; ok {
+		return er
+	}
+
+	er := &executionRing{}
+	h.rings[id] = er
+	if h.store == nil {
+		return er
+	}
+
+	rec, err := h.store.Load(id)
+	if err != nil {
+		if err != errHistoryNotFound {
+			log.Printf("Loading history for job %v failed: %v\n", id, err)
+		}
+		return er
+	}
+	for _, e := range rec.Executions {
+		er.add(e, h.size)
+	}
+	er.metrics = rec.Metrics
+	return er
+}
+
+// newExecution describes a finished run, ctxErr is the error of
+// the context it was run with
+func newExecution(runID string, ctxErr error, j Job, start time.Time, r Result, err error) jobExecution {
+	e := jobExecution{
+		RunID:      runID,
+		Start:      start,
+		DurationMS: time.Since(start).Milliseconds(),
+		Outcome:    outcomeSucceeded,
+	}
+
+	cause := jobFailed(j, r, err)
+	if cause != nil {
+		e.Outcome = outcomeFailed
+	}
+
+	e.Errors = resultErrors(r)
+	if len(e.Errors) == 0 {
+		e.Errors = collectErrors(j, cause)
+	}
+
+	// Finished with errors in part of its work
+	if cause == nil && len(e.Errors) > 0 {
+		e.Outcome = outcomePartial
+	}
+
+	switch ctxErr {
+	case context.DeadlineExceeded:
+		e.Outcome = outcomeTimedOut
+	case context.Canceled:
+		e.Outcome = outcomeCancelled
+	}
+	return e
+}
+
+// record adds e, an execution of j, to the history of job id
+func (h *jobHistory) record(id string, e jobExecution, j Job) {
+	metrics := json.RawMessage(j.Metrics())
+	if !json.Valid(metrics) {
+		metrics, _ = json.Marshal(string(metrics))
+	}
+
+	h.mux.Lock()
+	er := h.ring(id)
+	er.add(e, h.size)
+	er.metrics = metrics
+	rec := er.record()
+	h.mux.Unlock()
+
+	if h.store != nil {
+		if err := h.store.Save(id, rec); err != nil {
+			log.Printf("Saving history for job %v failed: %v\n", id, err)
+		}
+	}
+}
+
+// Get returns the history of job id
+func (h *jobHistory) Get(id string) jobRecord {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return h.ring(id).record()
+}
+
+// Find returns the latest execution of run runID of job id
+func (h *jobHistory) Find(id, runID string) (jobExecution, bool) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	rec := h.ring(id).record()
+	for i := len(rec.Executions) - 1; i >= 0; i-- {
+		if rec.Executions[i].RunID == runID {
+			return rec.Executions[i], true
+		}
+	}
+	return jobExecution{}, false
+}
+
+// Forget drops the history of a deleted job
+func (h *jobHistory) Forget(id string) {
+	h.mux.Lock()
+	delete(h.rings, id)
+	h.mux.Unlock()
+
+	if h.store != nil {
+		if err := h.store.Delete(id); err != nil {
+			log.Printf("Deleting history for job %v failed: %v\n", id, err)
+		}
+	}
+}
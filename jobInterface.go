@@ -1,10 +1,14 @@
 package main
 
+import "context"
+
 // Job interface abstraction for worker pools
 // ID() a unique ID assigned to each job
 // Type() string indicating the type of job
 //   for example, "HTTP Request"
 // Execute executes the job returning a Result
+//   Run must return once ctx is done, the dispatcher sets
+//   a deadline for each job type and cancels ctx on shutdown
 // Errors returns a list of errors to be logged
 type Job interface {
 	// Process methods
@@ -12,7 +16,7 @@ type Job interface {
 	Type() string
 	Init() error
 	InitWithJobChan(job chan Job) error
-	Run() (result Result, err error)
+	Run(ctx context.Context) (result Result, err error)
 	Pause() (status string, err error)
 	Shutdown() error
 	Errors() []error
@@ -0,0 +1,134 @@
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root
+// for full license information.
+//
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// JobFactory returns a new job, its fields are filled in by
+// json.Unmarshal or Init before it is sent to the dispatcher
+type JobFactory func() Job
+
+var errUnknownJobType = errors.New("unknown job type")
+
+// jobRegistry maps job type strings to factories and the schema
+// for their parameters
+var jobRegistry = struct {
+	factories map[string]JobFactory
+	schemas   map[string]*jobSchema
+	mux       sync.Mutex
+}{
+	factories: make(map[string]JobFactory),
+	schemas:   make(map[string]*jobSchema),
+}
+
+// jobTypeResponse describes a job type that can be created
+//
+// swagger:response jobTypeResponse
+type jobTypeResponse struct {
+	// in: body
+
+	// Type string used to create the job
+	Type string `json:"type"`
+
+	// Schema for the job's params, not set if any are accepted
+	Schema *jobSchema `json:"schema,omitempty"`
+}
+
+// RegisterJobType makes jobType available to Result.Decode, the
+// jobs API, and the job queue.  Call it from an init function in the
+// file implementing the job, registering a type twice panics.
+func RegisterJobType(jobType string, factory JobFactory) {
+	jobRegistry.mux.Lock()
+	defer jobRegistry.mux.Unlock()
+
+	if jobType == "" || factory == nil {
+		panic("RegisterJobType: job type and factory are required")
+	}
+	if _, dup := jobRegistry.factories[jobType]; dup {
+		panic("RegisterJobType: " + jobType + " registered twice")
+	}
+	jobRegistry.factories[jobType] = factory
+}
+
+// RegisterJobSchema sets the JSON schema params must match to
+// create a job of jobType, an invalid schema panics
+func RegisterJobSchema(jobType string, schema string) {
+	js, err := parseJobSchema(schema)
+	if err != nil {
+		panic("RegisterJobSchema: " + jobType + ": " + err.Error())
+	}
+
+	jobRegistry.mux.Lock()
+	jobRegistry.schemas[jobType] = js
+	jobRegistry.mux.Unlock()
+}
+
+// newJobOfType returns an empty job of jobType
+func newJobOfType(jobType string) (Job, error) {
+	jobRegistry.mux.Lock()
+	factory, ok := jobRegistry.factories[jobType]
+	jobRegistry.mux.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", errUnknownJobType, jobType)
+	}
+	return factory(), nil
+}
+
+// registeredJobTypes returns the registered types sorted
+func registeredJobTypes() []string {
+	jobRegistry.mux.Lock()
+	defer jobRegistry.mux.Unlock()
+
+	var types []string
+	for t := range jobRegistry.factories {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// newJobFromSpec returns a job of jobType with params applied once
+// they match the type's schema, Init is left to the caller
+func newJobFromSpec(jobType string, params json.RawMessage) (Job, error) {
+	j, err := newJobOfType(jobType)
+	if err != nil {
+		return nil, err
+	}
+
+	jobRegistry.mux.Lock()
+	js := jobRegistry.schemas[jobType]
+	jobRegistry.mux.Unlock()
+
+	if js != nil {
+		if err := js.Validate(params); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, j); err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidJobParams, err)
+		}
+	}
+	return j, nil
+}
+
+// jobTypes describes every registered job type
+func jobTypes() []jobTypeResponse {
+	var types []jobTypeResponse
+	for _, t := range registeredJobTypes() {
+		jobRegistry.mux.Lock()
+		types = append(types, jobTypeResponse{Type: t, Schema: jobRegistry.schemas[t]})
+		jobRegistry.mux.Unlock()
+	}
+	return types
+}
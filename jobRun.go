@@ -0,0 +1,182 @@
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root
+// for full license information.
+//
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// runNowTimeout seconds to wait for room on the job channel
+const runNowTimeout = 5
+
+// Run states until the run's execution is in the job's history,
+// after that its outcome is reported
+const (
+	runQueued  = "queued"
+	runRunning = "running"
+)
+
+// runJobRequest optional body for RunScheduleJob
+type runJobRequest struct {
+	// Params override the job's params for this run only
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// runStatusResponse is the state of one run of a job
+//
+// swagger:response runStatusResponse
+type runStatusResponse struct {
+	// in: body
+
+	// RunID to poll with
+	RunID string `json:"run_id"`
+
+	// JobID of the scheduled job
+	JobID string `json:"job_id"`
+
+	// Status queued, running, or the outcome once finished
+	Status string `json:"status"`
+
+	// Execution once the run has finished
+	Execution *jobExecution `json:"execution,omitempty"`
+}
+
+// mergeParams returns base with the top level keys in overrides replaced
+func mergeParams(base, overrides json.RawMessage) (json.RawMessage, error) {
+	if len(bytes.TrimSpace(base)) == 0 {
+		return overrides, nil
+	}
+
+	merged := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(base, &merged); err != nil {
+		return nil, err
+	}
+
+	o := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(overrides, &o); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidJobParams, err)
+	}
+	for k, v := range o {
+		merged[k] = v
+	}
+	return json.Marshal(merged)
+}
+
+// RunScheduleJob sends the job with UUID without waiting for its
+// next run.  Params in jsonBlob override the job's for this run only.
+// Returns a run ID GetScheduleJobRun can poll.
+func (s *eventScheduler) RunScheduleJob(UUID string, jsonBlob []byte) (httpStatusCode int, jsonb []byte, err error) {
+	var req runJobRequest
+
+	if len(bytes.TrimSpace(jsonBlob)) > 0 {
+		if e := json.Unmarshal(jsonBlob, &req); e != nil {
+			msg := fmt.Sprintf("{\"error\": \"json.Unmarshal failed\", \"Error\": \"%v\"}", e.Error())
+			return http.StatusBadRequest, []byte(msg), e
+		}
+	}
+
+	var job Job
+	for _, v := range s.jobs() {
+		if v.ID() == UUID {
+			job = v
+			break
+		}
+	}
+
+	if job == nil {
+		msg := fmt.Sprintf("{\"error\": \"Not found\", \"UUID\": %v}", UUID)
+		return http.StatusNotFound, []byte(msg), nil
+	}
+
+	if req.Params != nil {
+		params, e := mergeParams(s.jobParams(UUID), req.Params)
+		if e != nil {
+			msg := fmt.Sprintf("{\"error\": \"invalid params\", \"Error\": \"%v\"}", e.Error())
+			return http.StatusBadRequest, []byte(msg), e
+		}
+
+		var status int
+		job, status, e = s.buildJob(job.Type(), params)
+		if e != nil {
+			msg := fmt.Sprintf("{\"error\": \"job create failed\", \"Error\": \"%v\"}", e.Error())
+			return status, []byte(msg), e
+		}
+	}
+
+	// Runs started here skip the concurrency policy but count
+	// as active for scheduled runs
+	s.mux.Lock()
+	t, ok := s.timers[UUID]
+	var run *scheduledRun
+	if ok {
+		run = s.startRun(t, job)
+	}
+	s.mux.Unlock()
+
+	if run == nil {
+		msg := fmt.Sprintf("{\"error\": \"Not found\", \"UUID\": %v}", UUID)
+		return http.StatusNotFound, []byte(msg), nil
+	}
+
+	select {
+	case s.jobChan() <- run:
+	case <-time.After(runNowTimeout * time.Second):
+		s.runFinished(run)
+		e := errors.New("job channel full")
+		msg := fmt.Sprintf("{\"error\": \"run not sent\", \"Error\": \"%v\"}", e.Error())
+		return http.StatusServiceUnavailable, []byte(msg), e
+	}
+	s.MetricInc(adhocRuns)
+
+	jb, e := json.Marshal(runStatusResponse{RunID: run.runID, JobID: UUID, Status: runQueued})
+	if e != nil {
+		msg := fmt.Sprintf("{\"error\": \"json.Marshal failed\", \"Error\": \"%v\"}", e.Error())
+		return http.StatusInternalServerError, []byte(msg), e
+	}
+	return http.StatusAccepted, jb, nil
+}
+
+// GetScheduleJobRun returns the state of run runID of the job
+// with UUID, runs are found until they drop out of its history
+func (s *eventScheduler) GetScheduleJobRun(UUID, runID string) (httpStatusCode int, jsonBlob []byte, err error) {
+	rs := runStatusResponse{RunID: runID, JobID: UUID}
+
+	s.mux.Lock()
+	_, known := s.timers[UUID]
+	if run, ok := s.runs[runID]; ok && run.jobID == UUID {
+		rs.Status = runQueued
+		if run.running {
+			rs.Status = runRunning
+		}
+	}
+	s.mux.Unlock()
+
+	if !known {
+		msg := fmt.Sprintf("{\"error\": \"Not found\", \"UUID\": %v}", UUID)
+		return http.StatusNotFound, []byte(msg), nil
+	}
+
+	if rs.Status == "" {
+		e, ok := s.history.Find(UUID, runID)
+		if !ok {
+			msg := fmt.Sprintf("{\"error\": \"Not found\", \"UUID\": %v, \"run_id\": %v}", UUID, runID)
+			return http.StatusNotFound, []byte(msg), nil
+		}
+		rs.Status = e.Outcome
+		rs.Execution = &e
+	}
+
+	jb, e := json.Marshal(rs)
+	if e != nil {
+		msg := fmt.Sprintf("{\"error\": \"json.Marshal failed\", \"Error\": \"%v\"}", e.Error())
+		return http.StatusInternalServerError, []byte(msg), e
+	}
+	return http.StatusOK, jb, nil
+}
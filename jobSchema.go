@@ -0,0 +1,160 @@
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root
+// for full license information.
+//
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+var errInvalidJobParams = errors.New("invalid job parameters")
+
+// jobSchema is the subset of JSON Schema used to check the
+// parameters a job is created with
+type jobSchema struct {
+	Type                 string                `json:"type,omitempty"`
+	Description          string                `json:"description,omitempty"`
+	Properties           map[string]*jobSchema `json:"properties,omitempty"`
+	Required             []string              `json:"required,omitempty"`
+	AdditionalProperties *bool                 `json:"additionalProperties,omitempty"`
+	Items                *jobSchema            `json:"items,omitempty"`
+	Enum                 []interface{}         `json:"enum,omitempty"`
+	Minimum              *float64              `json:"minimum,omitempty"`
+	Format               string                `json:"format,omitempty"` // only uuid is checked
+}
+
+// parseJobSchema decodes a schema rejecting keywords it doesn't support
+func parseJobSchema(schema string) (*jobSchema, error) {
+	js := &jobSchema{}
+	dec := json.NewDecoder(bytes.NewReader([]byte(schema)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(js); err != nil {
+		return nil, err
+	}
+	return js, nil
+}
+
+// Validate checks params, a JSON document, against the schema
+func (js *jobSchema) Validate(params []byte) error {
+	var v interface{}
+	if len(bytes.TrimSpace(params)) == 0 {
+		v = map[string]interface{}{}
+	} else if err := json.Unmarshal(params, &v); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidJobParams, err)
+	}
+
+	if err := js.validate("params", v); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidJobParams, err)
+	}
+	return nil
+}
+
+// validate checks v found at path
+func (js *jobSchema) validate(path string, v interface{}) error {
+	if len(js.Enum) > 0 && !js.inEnum(v) {
+		return fmt.Errorf("%s must be one of %v", path, js.Enum)
+	}
+
+	switch js.Type {
+	case "":
+		return nil
+
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an object", path)
+		}
+		return js.validateObject(path, obj)
+
+	case "array":
+		list, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an array", path)
+		}
+		if js.Items != nil {
+			for i, item := range list {
+				if err := js.Items.validate(fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+					return err
+				}
+			}
+		}
+
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s must be a string", path)
+		}
+		if js.Format == "uuid" {
+			if _, err := uuid.Parse(s); err != nil {
+				return fmt.Errorf("%s must be a uuid", path)
+			}
+		}
+
+	case "integer", "number":
+		n, ok := v.(float64)
+		if !ok || (js.Type == "integer" && n != math.Trunc(n)) {
+			return fmt.Errorf("%s must be an %s", path, js.Type)
+		}
+		if js.Minimum != nil && n < *js.Minimum {
+			return fmt.Errorf("%s must be %v or more", path, *js.Minimum)
+		}
+
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s must be a boolean", path)
+		}
+
+	default:
+		return fmt.Errorf("%s has unsupported schema type %s", path, js.Type)
+	}
+
+	return nil
+}
+
+// validateObject checks required and known properties
+func (js *jobSchema) validateObject(path string, obj map[string]interface{}) error {
+	for _, name := range js.Required {
+		if _, ok := obj[name]; !ok {
+			return fmt.Errorf("%s.%s is required", path, name)
+		}
+	}
+
+	// Sorted so the first error reported is stable
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		prop, ok := js.Properties[name]
+		if !ok {
+			if js.AdditionalProperties != nil && !*js.AdditionalProperties {
+				return fmt.Errorf("%s.%s is not a known parameter", path, name)
+			}
+			continue
+		}
+		if err := prop.validate(path+"."+name, obj[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inEnum is true if v equals one of js.Enum
+func (js *jobSchema) inEnum(v interface{}) bool {
+	for _, e := range js.Enum {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
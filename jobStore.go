@@ -0,0 +1,338 @@
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root
+// for full license information.
+//
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// JobQueueFile name of the write ahead log in EB_JOB_QUEUE_DIR,
+// setting EB_JOB_QUEUE_DIR turns on the durable job queue
+const JobQueueFile string = "jobs.wal"
+
+// walCompactAfter acknowledgements before the log is rewritten
+const walCompactAfter = 1000
+
+// walMaxRecord bytes in a single log record
+const walMaxRecord = 16 * 1024 * 1024
+
+// Log record operations
+const (
+	walAdd = "add"
+	walAck = "ack"
+)
+
+// Metrics constants
+const (
+	dispatcherJobsPersisted = "jobs_persisted"
+	dispatcherJobsReplayed  = "jobs_replayed"
+	dispatcherJobsDurable   = "durable_jobs_pending"
+)
+
+var errJobStoreClosed = errors.New("job store closed")
+
+// durableJob is implemented by jobs that should survive a restart
+type durableJob interface {
+	Durable() bool
+}
+
+// jobStore persists jobs until they are acknowledged, implement
+// it to keep jobs somewhere other than local disk
+type jobStore interface {
+	Append(j Job) error
+	Ack(id string) error
+	Pending() ([]walRecord, error)
+	Close() error
+}
+
+// walRecord is a line in the log, jobs are stored as the same JSON
+// Result.Decode uses
+type walRecord struct {
+	Op      string          `json:"op"`
+	ID      string          `json:"id"`
+	JobType string          `json:"job_type,omitempty"`
+	Job     json.RawMessage `json:"job,omitempty"`
+}
+
+// walJobStore is an append only log of added and acknowledged jobs
+type walJobStore struct {
+	path    string
+	f       *os.File
+	pending map[string]walRecord
+	order   []string // IDs in the order they were added, may include acked IDs
+	acked   int      // since the last compaction
+	mux     *sync.Mutex
+}
+
+// newWALJobStore opens or creates the log in dir
+func newWALJobStore(dir string) (*walJobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	ws := &walJobStore{
+		path:    filepath.Join(dir, JobQueueFile),
+		pending: make(map[string]walRecord),
+		mux:     &sync.Mutex{},
+	}
+
+	if err := ws.load(); err != nil {
+		return nil, err
+	}
+
+	// Drops acknowledged jobs and any partly written record
+	if err := ws.compact(); err != nil {
+		return nil, err
+	}
+	return ws, nil
+}
+
+// load reads the log, a record cut short by a crash ends it
+func (ws *walJobStore) load() error {
+	f, err := os.Open(ws.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), walMaxRecord)
+
+	for scanner.Scan() {
+		var rec walRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			log.Printf("Job queue %s: ignoring bad record: %v\n", ws.path, err)
+			break
+		}
+
+		switch rec.Op {
+		case walAdd:
+			ws.pending[rec.ID] = rec
+			ws.order = append(ws.order, rec.ID)
+		case walAck:
+			delete(ws.pending, rec.ID)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Printf("Job queue %s: read stopped: %v\n", ws.path, err)
+	}
+	return nil
+}
+
+// write appends rec and flushes it to disk, the caller holds ws.mux
+func (ws *walJobStore) write(rec walRecord) error {
+	if ws.f == nil {
+		return errJobStoreClosed
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	if _, err := ws.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return ws.f.Sync()
+}
+
+// compact rewrites the log with only pending jobs
+func (ws *walJobStore) compact() error {
+	tmp := ws.path + ".tmp"
+	var buf bytes.Buffer
+	var order []string
+
+	for _, id := range ws.order {
+		rec, ok := ws.pending[id]
+		if !ok {
+			continue
+		}
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(data, '\n'))
+		order = append(order, id)
+	}
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+
+	if err := os.Rename(tmp, ws.path); err != nil {
+		return err
+	}
+
+	if ws.f != nil {
+		ws.f.Close()
+	}
+	ws.f, err = os.OpenFile(ws.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	ws.order = order
+	ws.acked = 0
+	return nil
+}
+
+// Append persists j
+func (ws *walJobStore) Append(j Job) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	rec := walRecord{Op: walAdd, ID: j.ID(), JobType: j.Type(), Job: data}
+
+	ws.mux.Lock()
+	defer ws.mux.Unlock()
+
+	if err := ws.write(rec); err != nil {
+		return err
+	}
+	ws.pending[rec.ID] = rec
+	ws.order = append(ws.order, rec.ID)
+	return nil
+}
+
+// Ack removes the job with id once it has finished
+func (ws *walJobStore) Ack(id string) error {
+	ws.mux.Lock()
+	defer ws.mux.Unlock()
+
+	if _, ok := ws.pending[id]; !ok {
+		return nil
+	}
+
+	if err := ws.write(walRecord{Op: walAck, ID: id}); err != nil {
+		return err
+	}
+	delete(ws.pending, id)
+
+	ws.acked++
+	if ws.acked >= walCompactAfter {
+		return ws.compact()
+	}
+	return nil
+}
+
+// Pending returns jobs not yet acknowledged in the order added
+func (ws *walJobStore) Pending() ([]walRecord, error) {
+	ws.mux.Lock()
+	defer ws.mux.Unlock()
+
+	var recs []walRecord
+	for _, id := range ws.order {
+		if rec, ok := ws.pending[id]; ok {
+			recs = append(recs, rec)
+		}
+	}
+	return recs, nil
+}
+
+// Close closes the log, pending jobs are replayed when it is reopened
+func (ws *walJobStore) Close() error {
+	ws.mux.Lock()
+	defer ws.mux.Unlock()
+
+	if ws.f == nil {
+		return nil
+	}
+	err := ws.f.Close()
+	ws.f = nil
+	return err
+}
+
+// persist stores j if it is durable and a store is configured
+func (d *dispatcher) persist(j Job) {
+	if d.jobStore == nil {
+		return
+	}
+	if dj, ok := j.(durableJob); !ok || !dj.Durable() {
+		return
+	}
+
+	if err := d.jobStore.Append(j); err != nil {
+		log.Printf("Job: %v not persisted: %v\n", j.ID(), err)
+		return
+	}
+	d.MetricInc(dispatcherJobsPersisted)
+	d.MetricInc(dispatcherJobsDurable)
+}
+
+// acknowledge removes j from the store once it won't run again
+func (d *dispatcher) acknowledge(j Job) {
+	if d.jobStore == nil {
+		return
+	}
+	if dj, ok := j.(durableJob); !ok || !dj.Durable() {
+		return
+	}
+
+	if err := d.jobStore.Ack(j.ID()); err != nil {
+		log.Printf("Job: %v acknowledge failed: %v\n", j.ID(), err)
+		return
+	}
+	d.MetricDec(dispatcherJobsDurable)
+}
+
+// replayJobs queues jobs left in the store by the last run
+// Replayed jobs get new IDs so each is stored again under its
+// new ID before the old entry is acknowledged
+func (d *dispatcher) replayJobs() {
+	if d.jobStore == nil {
+		return
+	}
+
+	recs, err := d.jobStore.Pending()
+	if err != nil {
+		log.Printf("Reading job queue failed: %v\n", err)
+		return
+	}
+
+	for _, rec := range recs {
+		lr := &logResult{job: rec.Job, jobType: rec.JobType}
+		j, err := lr.Decode()
+		if err == nil {
+			err = j.InitWithJobChan(d.jobChannel())
+		}
+		if err != nil {
+			log.Printf("Job: %v can't be replayed: %v\n", rec.ID, err)
+			d.jobStore.Ack(rec.ID)
+			continue
+		}
+
+		d.persist(j)
+		if err := d.jobStore.Ack(rec.ID); err != nil {
+			log.Printf("Job: %v acknowledge failed: %v\n", rec.ID, err)
+		}
+		d.queues.Push(j)
+		d.MetricInc(dispatcherJobsReplayed)
+	}
+
+	if len(recs) > 0 {
+		log.Printf("Replayed %d jobs from the job queue\n", len(recs))
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root
+// for full license information.
+//
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JobTimeout seconds a job type without its own setting may run
+// 0 disables the deadline
+const JobTimeout int = 300
+
+// defaultJobTimeouts per job type in seconds
+var defaultJobTimeouts = map[string]int{
+	LogQueueJobType:     600,
+	LogProcessorJobType: 300,
+}
+
+// Management API
+const jobTimeoutPrefix string = "job_timeout_seconds:"
+
+// Metrics constants
+const (
+	dispatcherJobsTimedOut = "jobs_deadline_exceeded"
+	dispatcherJobsCanceled = "jobs_cancelled"
+)
+
+// runningJob is a job being run by a worker
+type runningJob struct {
+	job    Job
+	cancel context.CancelFunc
+}
+
+// jobTimeouts sets a deadline on each run and cancels runs on request
+type jobTimeouts struct {
+	d        *dispatcher
+	ctx      context.Context // parent of every run, cancelled by CancelAll
+	cancel   context.CancelFunc
+	timeouts map[string]int // seconds by job type
+	running  map[*runningJob]bool
+	mux      *sync.Mutex
+}
+
+// Init sets defaults
+func (jt *jobTimeouts) Init(d *dispatcher) {
+	jt.d = d
+	jt.mux = &sync.Mutex{}
+	jt.ctx, jt.cancel = context.WithCancel(d.ctx)
+	jt.running = make(map[*runningJob]bool)
+	jt.timeouts = make(map[string]int)
+	for t, n := range defaultJobTimeouts {
+		jt.timeouts[t] = n
+	}
+}
+
+// Fields returns the management fields jobTimeouts handles
+func (jt *jobTimeouts) Fields() []string {
+	return []string{
+		jobTimeoutPrefix + LogQueueJobType,
+		jobTimeoutPrefix + LogProcessorJobType}
+}
+
+// Handles is true for fields SetConfigVariable accepts
+func (jt *jobTimeouts) Handles(name string) bool {
+	return strings.HasPrefix(name, jobTimeoutPrefix)
+}
+
+// SetConfigVariable changes the timeout for a job type
+func (jt *jobTimeouts) SetConfigVariable(name string, value int) (msg []byte, err error) {
+	var rmsg string
+
+	jobType := strings.TrimPrefix(name, jobTimeoutPrefix)
+	if jobType == "" || value < 0 {
+		rmsg = fmt.Sprintf("{\"Status\": \"%s needs a job type and a value of 0 or more\"}", name)
+		return []byte(rmsg), errors.New("invalid job timeout")
+	}
+
+	jt.mux.Lock()
+	old := jt.timeoutFor(jobType)
+	jt.timeouts[jobType] = value
+	jt.mux.Unlock()
+
+	rmsg = fmt.Sprintf("{\"Status\": \"%s changed from %d to %d\"}",
+		name, old, value)
+	return []byte(rmsg), nil
+}
+
+// timeoutFor returns seconds for jobType, the caller holds jt.mux
+func (jt *jobTimeouts) timeoutFor(jobType string) int {
+	if n, ok := jt.timeouts[jobType]; ok {
+		return n
+	}
+	return JobTimeout
+}
+
+// Context returns the context to run j with.  The returned
+// CancelFunc must be called once the run is finished.
+func (jt *jobTimeouts) Context(j Job) (context.Context, context.CancelFunc) {
+	jt.mux.Lock()
+	defer jt.mux.Unlock()
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if n := jt.timeoutFor(j.Type()); n > 0 {
+		ctx, cancel = context.WithTimeout(jt.ctx, time.Duration(n)*time.Second)
+	} else {
+		ctx, cancel = context.WithCancel(jt.ctx)
+	}
+
+	rj := &runningJob{job: j, cancel: cancel}
+	jt.running[rj] = true
+
+	return ctx, func() {
+		jt.mux.Lock()
+		delete(jt.running, rj)
+		jt.mux.Unlock()
+		cancel()
+	}
+}
+
+// Cancel cancels the running job with id, or every run of the
+// scheduled job with id, returning how many were found
+func (jt *jobTimeouts) Cancel(id string) int {
+	jt.mux.Lock()
+	defer jt.mux.Unlock()
+
+	n := 0
+	for rj := range jt.running {
+		sr, scheduled := rj.job.(*scheduledRun)
+		if rj.job.ID() == id || (scheduled && sr.jobID == id) {
+			rj.cancel()
+			n++
+		}
+	}
+	return n
+}
+
+// CancelRunning cancels every running job returning how many there were
+func (jt *jobTimeouts) CancelRunning() int {
+	jt.mux.Lock()
+	defer jt.mux.Unlock()
+
+	for rj := range jt.running {
+		rj.cancel()
+	}
+	return len(jt.running)
+}
+
+// CancelAll cancels running jobs and any started later
+func (jt *jobTimeouts) CancelAll() {
+	jt.mux.Lock()
+	n := len(jt.running)
+	jt.mux.Unlock()
+
+	jt.cancel()
+	if n > 0 {
+		log.Printf("Cancelled %d running jobs\n", n)
+	}
+}
+
+// runEnded records why a run's context ended, if it did
+func (jt *jobTimeouts) runEnded(j Job, ctx context.Context) {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		jt.d.MetricInc(dispatcherJobsTimedOut)
+		log.Printf("Job: %v deadline exceeded\n", j.ID())
+	case context.Canceled:
+		jt.d.MetricInc(dispatcherJobsCanceled)
+		log.Printf("Job: %v cancelled\n", j.ID())
+	}
+}
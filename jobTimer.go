@@ -0,0 +1,549 @@
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root
+// for full license information.
+//
+package main
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Concurrency policies, what to do when a job is due while an
+// earlier run of it is still in progress
+const (
+	// concurrencyForbid skips the new run, the default
+	concurrencyForbid = "forbid"
+
+	// concurrencyReplace cancels the earlier run and starts the new one
+	concurrencyReplace = "replace"
+
+	// concurrencyAllow runs both
+	concurrencyAllow = "allow"
+)
+
+// jobSchedule is an optional per job schedule.  A job without an
+// interval or cron expression follows the scheduler's eventSchedule.
+type jobSchedule struct {
+	// IntervalSeconds between runs of this job
+	IntervalSeconds int64 `json:"interval_seconds,omitempty"`
+
+	// CronExpression for this job, see parseCron
+	CronExpression string `json:"cron_expression,omitempty"`
+
+	// TimeZone for CronExpression, defaults to UTC
+	TimeZone string `json:"time_zone,omitempty"`
+
+	// JitterSeconds random delay of up to this many seconds
+	// added to each run
+	JitterSeconds int64 `json:"jitter_seconds,omitempty"`
+
+	// Enabled defaults to true, disabled jobs are not sent
+	Enabled *bool `json:"enabled,omitempty"`
+
+	// ConcurrencyPolicy forbid, replace or allow, defaults to forbid
+	ConcurrencyPolicy string `json:"concurrency_policy,omitempty"`
+
+	// Priority class high, normal or low, defaults to normal
+	Priority string `json:"priority,omitempty"`
+}
+
+// validate checks the schedule returning the parsed cron expression
+// if there is one
+func (js *jobSchedule) validate() (*cronSchedule, error) {
+	if js.IntervalSeconds < 0 {
+		return nil, errors.New("interval_seconds must not be negative")
+	}
+
+	if js.JitterSeconds < 0 {
+		return nil, errors.New("jitter_seconds must not be negative")
+	}
+
+	switch js.ConcurrencyPolicy {
+	case "", concurrencyForbid, concurrencyReplace, concurrencyAllow:
+	default:
+		return nil, fmt.Errorf("concurrency_policy must be %q, %q or %q",
+			concurrencyForbid, concurrencyReplace, concurrencyAllow)
+	}
+
+	if !validPriority(js.Priority) {
+		return nil, fmt.Errorf("priority must be %q, %q or %q",
+			priorityHigh, priorityNormal, priorityLow)
+	}
+
+	if js.CronExpression == "" {
+		return nil, nil
+	}
+
+	if js.IntervalSeconds > 0 {
+		return nil, errors.New("use interval_seconds or cron_expression, not both")
+	}
+
+	loc, err := time.LoadLocation(js.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("bad time_zone: %v", err)
+	}
+	return parseCron(js.CronExpression, loc)
+}
+
+// enabled is true unless Enabled is set to false
+func (js *jobSchedule) enabled() bool {
+	return js.Enabled == nil || *js.Enabled
+}
+
+// merge overrides fields set in update
+func (js jobSchedule) merge(update jobSchedule) jobSchedule {
+	if update.IntervalSeconds != 0 || update.CronExpression != "" {
+		js.IntervalSeconds = update.IntervalSeconds
+		js.CronExpression = update.CronExpression
+		js.TimeZone = update.TimeZone
+	}
+	if update.JitterSeconds != 0 {
+		js.JitterSeconds = update.JitterSeconds
+	}
+	if update.Enabled != nil {
+		js.Enabled = update.Enabled
+	}
+	if update.ConcurrencyPolicy != "" {
+		js.ConcurrencyPolicy = update.ConcurrencyPolicy
+	}
+	if update.Priority != "" {
+		js.Priority = update.Priority
+	}
+	return js
+}
+
+// policy returns the concurrency policy with the default applied
+func (js *jobSchedule) policy() string {
+	if js.ConcurrencyPolicy == "" {
+		return concurrencyForbid
+	}
+	return js.ConcurrencyPolicy
+}
+
+// jobTimer tracks when a job is next sent
+type jobTimer struct {
+	job      Job
+	schedule jobSchedule
+	params   json.RawMessage // the job was created with
+	cron     *cronSchedule
+	lastRun  time.Time
+	due      time.Time // the last run was due, before its jitter
+	jitter   time.Duration
+	next     time.Time
+	index    int // position in jobHeap, -1 if not queued
+	active   map[*scheduledRun]bool
+	skipped  int
+}
+
+// runCopier is implemented by jobs that give each scheduled run its
+// own copy, jobs without it share one value across runs
+type runCopier interface {
+	runCopy(js jobSchedule) Job
+}
+
+// scheduledRun is one run of a scheduled job.  Each run gets its own
+// copy of the job so overlapping runs don't share Stats.
+type scheduledRun struct {
+	Job
+	s          *eventScheduler
+	jobID      string             // of the scheduled job, the copy's may differ
+	runID      string             // identifies this run in the job's history
+	priority   string             // from the schedule, overrides the job's
+	running    bool               // guarded by s.mux
+	superseded bool               // guarded by s.mux
+	cancel     context.CancelFunc // guarded by s.mux, set while running
+	waiting    *jobExecution      // guarded by s.mux, set until children finish
+}
+
+// MarshalJSON encodes the job so results decode to its type
+func (r *scheduledRun) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.Job)
+}
+
+// ID is the run's, overlapping runs of a job are retried, cancelled,
+// and counted against their tenant on their own
+func (r *scheduledRun) ID() string {
+	return r.runID
+}
+
+// Priority returns the schedule's class, or the job's if it has none
+func (r *scheduledRun) Priority() string {
+	if r.priority != "" {
+		return r.priority
+	}
+	if pj, ok := r.Job.(prioritizedJob); ok {
+		return pj.Priority()
+	}
+	return ""
+}
+
+// Tenant returns the job's tenant, if it has one
+func (r *scheduledRun) Tenant() string {
+	if tj, ok := r.Job.(tenantJob); ok {
+		return tj.Tenant()
+	}
+	return ""
+}
+
+// TenantLimit returns the job's tenant limit, if it has one
+func (r *scheduledRun) TenantLimit() int {
+	if tj, ok := r.Job.(tenantJob); ok {
+		return tj.TenantLimit()
+	}
+	return 0
+}
+
+// Durable is true if the job is kept across restarts
+func (r *scheduledRun) Durable() bool {
+	dj, ok := r.Job.(durableJob)
+	return ok && dj.Durable()
+}
+
+// Run runs the job and tells the scheduler it has finished
+// Replacing the run cancels ctx
+func (r *scheduledRun) Run(ctx context.Context) (result Result, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	r.s.mux.Lock()
+	r.cancel = cancel
+	r.running = true
+	if r.superseded {
+		cancel()
+	}
+	r.s.mux.Unlock()
+
+	waiting := false
+	defer func() {
+		if !waiting {
+			r.s.runFinished(r)
+		}
+	}()
+
+	start := time.Now()
+	result, err = r.Job.Run(ctx)
+	e := newExecution(r.runID, ctx.Err(), r.Job, start, result, err)
+
+	// Runs that submitted children finish when they do
+	if cs, ok := SubmitterFromContext(ctx).(*childSubmitter); ok && cs.children() > 0 {
+		waiting = true
+		r.s.mux.Lock()
+		r.waiting = &e
+		r.s.mux.Unlock()
+		return result, err
+	}
+
+	r.s.history.record(r.jobID, e, r.Job)
+	return result, err
+}
+
+// childrenDone records a run that was waiting for its children
+func (r *scheduledRun) childrenDone(total, failed int) {
+	r.s.mux.Lock()
+	e := r.waiting
+	r.waiting = nil
+	r.s.mux.Unlock()
+
+	if e == nil {
+		return
+	}
+
+	e.DurationMS = time.Since(e.Start).Milliseconds()
+	if failed > 0 {
+		if e.Outcome == outcomeSucceeded || e.Outcome == outcomePartial {
+			e.Outcome = outcomeFailed
+		}
+		// The children were retried on their own
+		e.Errors = append(e.Errors, JobError{
+			Code:    errCodeChildren,
+			Message: fmt.Sprintf("%d of %d children failed", failed, total),
+			Time:    time.Now(),
+		})
+	}
+
+	r.s.history.record(r.jobID, *e, r.Job)
+	r.s.runFinished(r)
+}
+
+// drawJitter picks the delay for the next run
+func (t *jobTimer) drawJitter() {
+	t.jitter = 0
+	if t.schedule.JitterSeconds > 0 {
+		t.jitter = time.Duration(rand.Int63n(t.schedule.JitterSeconds*int64(time.Second) + 1))
+	}
+}
+
+// jobHeap orders timers by next run time, implements heap.Interface
+type jobHeap []*jobTimer
+
+func (h jobHeap) Len() int           { return len(h) }
+func (h jobHeap) Less(i, j int) bool { return h[i].next.Before(h[j].next) }
+func (h jobHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *jobHeap) Push(x interface{}) {
+	t := x.(*jobTimer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *jobHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = nil
+	t.index = -1
+	*h = old[:n-1]
+	return t
+}
+
+// setJobSchedule creates or replaces the timer for job
+// The caller holds s.mux
+func (s *eventScheduler) setJobSchedule(job Job, js jobSchedule, cs *cronSchedule, params json.RawMessage) {
+	t, ok := s.timers[job.ID()]
+	if !ok {
+		t = &jobTimer{job: job, index: -1, active: make(map[*scheduledRun]bool)}
+		s.timers[job.ID()] = t
+	}
+	t.schedule = js
+	t.cron = cs
+	t.params = params
+	t.drawJitter()
+}
+
+// rebuildTimers recomputes next run times and the heap from jobList
+// The caller holds s.mux
+func (s *eventScheduler) rebuildTimers() {
+	now := time.Now()
+	live := make(map[string]bool, len(s.jobList))
+	s.timerHeap = s.timerHeap[:0]
+
+	for _, j := range s.jobList {
+		id := j.ID()
+		live[id] = true
+
+		t, ok := s.timers[id]
+		if !ok {
+			t = &jobTimer{job: j, active: make(map[*scheduledRun]bool)}
+			s.timers[id] = t
+		}
+		t.index = -1
+
+		if !t.schedule.enabled() {
+			continue
+		}
+
+		t.next = s.timerNext(t, now)
+		if !t.next.IsZero() {
+			heap.Push(&s.timerHeap, t)
+		}
+	}
+
+	// Forget deleted jobs
+	for id := range s.timers {
+		if !live[id] {
+			delete(s.timers, id)
+		}
+	}
+}
+
+// timerNext computes when t is next due.  Jobs with their own
+// schedule use it, the rest follow the scheduler's eventSchedule.
+// The caller holds s.mux
+func (s *eventScheduler) timerNext(t *jobTimer, now time.Time) time.Time {
+	cs := t.cron
+	interval := time.Duration(t.schedule.IntervalSeconds) * time.Second
+
+	if cs == nil && interval == 0 {
+		if s.schedule.ScheduleType == cronScheduler {
+			cs = s.cron
+		}
+		interval = time.Duration(s.schedule.SendIntervalSeconds) * time.Second
+	}
+
+	var next time.Time
+	switch {
+	case cs != nil:
+		// Don't skip a run that is only waiting on its jitter
+		from := now.Add(-t.jitter)
+		if t.lastRun.After(from) {
+			from = t.lastRun
+		}
+		next = cs.Next(from)
+		if next.IsZero() {
+			return next
+		}
+	case t.lastRun.IsZero():
+		next = now
+	default:
+		// Count from when the last run was due so its jitter
+		// doesn't push every later run back
+		next = t.due.Add(interval)
+		if next.Before(now) {
+			next = now
+		}
+	}
+
+	return next.Add(t.jitter)
+}
+
+// dueJobs removes and returns jobs due at now, rescheduling each one
+func (s *eventScheduler) dueJobs(now time.Time) []Job {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	var due []Job
+	for len(s.timerHeap) > 0 && !s.timerHeap[0].next.After(now) {
+		t := heap.Pop(&s.timerHeap).(*jobTimer)
+		due = append(due, t.job)
+
+		t.lastRun = now
+		t.due = t.next.Add(-t.jitter)
+		t.drawJitter()
+		t.next = s.timerNext(t, now)
+		if !t.next.IsZero() {
+			heap.Push(&s.timerHeap, t)
+		}
+	}
+
+	return due
+}
+
+// newRun applies the job's concurrency policy returning the run to
+// send, or nil if the run is skipped
+func (s *eventScheduler) newRun(j Job) *scheduledRun {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	t, ok := s.timers[j.ID()]
+	if !ok {
+		// Deleted since it was due
+		return nil
+	}
+
+	if len(t.active) > 0 {
+		switch t.schedule.policy() {
+		case concurrencyForbid:
+			t.skipped++
+			s.MetricInc(skippedRuns)
+			log.Printf("Job %v still running, skipping this run\n", j.ID())
+			return nil
+
+		case concurrencyReplace:
+			for r := range t.active {
+				r.superseded = true
+				if r.cancel != nil {
+					r.cancel()
+				}
+			}
+			s.MetricInc(replacedRuns)
+			log.Printf("Job %v still running, replacing it\n", j.ID())
+		}
+	}
+
+	return s.startRun(t, j)
+}
+
+// startRun returns a run of j for the job t times
+// The caller holds s.mux
+func (s *eventScheduler) startRun(t *jobTimer, j Job) *scheduledRun {
+	if rc, ok := j.(runCopier); ok {
+		j = rc.runCopy(t.schedule)
+	}
+
+	run := &scheduledRun{
+		Job:      j,
+		s:        s,
+		jobID:    t.job.ID(),
+		runID:    uuid.New().String(),
+		priority: t.schedule.Priority,
+	}
+	t.active[run] = true
+	s.runs[run.runID] = run
+	return run
+}
+
+// runFinished releases a run that completed or was never sent
+func (s *eventScheduler) runFinished(r *scheduledRun) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if r.superseded {
+		log.Printf("Job %v finished after it was replaced\n", r.jobID)
+	}
+
+	if t, ok := s.timers[r.jobID]; ok {
+		delete(t.active, r)
+	}
+	delete(s.runs, r.runID)
+}
+
+// jobRuns returns how many runs of the job with id are in
+// progress and how many were skipped
+func (s *eventScheduler) jobRuns(id string) (running, skipped int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if t, ok := s.timers[id]; ok {
+		return len(t.active), t.skipped
+	}
+	return 0, 0
+}
+
+// jobNextRun returns when the job with id is next sent, the
+// zero time if it is disabled or unknown
+func (s *eventScheduler) jobNextRun(id string) time.Time {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if t, ok := s.timers[id]; ok && t.index >= 0 {
+		return t.next
+	}
+	return time.Time{}
+}
+
+// jobParams returns the params the job with id was created with
+func (s *eventScheduler) jobParams(id string) json.RawMessage {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if t, ok := s.timers[id]; ok {
+		return t.params
+	}
+	return nil
+}
+
+// jobScheduleFor returns the schedule for the job with id
+func (s *eventScheduler) jobScheduleFor(id string) jobSchedule {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if t, ok := s.timers[id]; ok {
+		return t.schedule
+	}
+	return jobSchedule{}
+}
+
+// timersChanged rebuilds the heap and wakes the scheduler
+func (s *eventScheduler) timersChanged() {
+	s.mux.Lock()
+	s.rebuildTimers()
+	s.mux.Unlock()
+
+	select {
+	case s.scheduleChanged <- true:
+	default:
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -27,16 +28,51 @@ const (
 	ClientTimeout int = 30
 )
 
+// errNoLog a log download was created without a log, and no workflow
+// step passed one on
+var errNoLog = errors.New("no log to process")
+
+// logProcessorJobSchema for the params a log download is created with,
+// a workflow step may leave Log out and take it from the step before
+const logProcessorJobSchema string = `{
+	"type": "object",
+	"properties": {
+		"Log": {"type": "object",
+			"description": "The log object to process, see s3.LogQueueItem",
+			"required": ["id", "bucket", "name", "location"],
+			"properties": {
+				"id": {"type": "string", "format": "uuid"},
+				"bucket": {"type": "string"},
+				"name": {"type": "string"},
+				"location": {"type": "string"},
+				"logFormat": {"type": "string"},
+				"plogConfigID": {"type": "string"},
+				"prune": {"type": "boolean"}
+			}
+		},
+		"client_timeout": {"type": "integer", "minimum": 1},
+		"max_in_flight": {"type": "integer", "minimum": 0}
+	},
+	"additionalProperties": false
+}`
+
+func init() {
+	RegisterJobType(LogProcessorJobType, func() Job { return &logProcessorJob{} })
+	RegisterJobSchema(LogProcessorJobType, logProcessorJobSchema)
+}
+
 // logProcessorJob type for dispatcher to run
 type logProcessorJob struct {
-	ctx           context.Context `json:"ctx"`
-	JobID         uuid.UUID       `json:"job_id"`
-	JobType       string          `json:"job_type"`
-	client        *http.Client    `json:"client"`
-	ClientTimeout int             `json:"client_timeout"`
+	ctx           context.Context
+	JobID         uuid.UUID `json:"job_id"`
+	JobType       string    `json:"job_type"`
+	client        *http.Client
+	ClientTimeout int `json:"client_timeout"`
 	Log           s3.LogQueueItem
-	// TODO: FIX to errors or custom errors
-	jobErrors []string  `json:"jobErrors"`
+	PriorityClass string `json:"priority,omitempty"`
+	MaxInFlight   int    `json:"max_in_flight,omitempty"`
+	// Errors from the last run
+	jobErrors []error
 	JobURL    *url.URL  `json:"job_url"`
 	Stats     httpStats `json:"stats"`
 }
@@ -55,6 +91,26 @@ func (j *logProcessorJob) Type() string {
 	return LogProcessorJobType
 }
 
+// Priority returns the class the dispatcher queues this job in
+func (j *logProcessorJob) Priority() string {
+	return j.PriorityClass
+}
+
+// Tenant is the customer the log belongs to
+func (j *logProcessorJob) Tenant() string {
+	return j.Log.ID
+}
+
+// TenantLimit is the customer's limit on jobs in flight
+func (j *logProcessorJob) TenantLimit() int {
+	return j.MaxInFlight
+}
+
+// Durable queued log downloads are replayed after a restart
+func (j *logProcessorJob) Durable() bool {
+	return true
+}
+
 func (j *logProcessorJob) InitWithJobChan(job chan Job) error {
 
 	return j.Init()
@@ -80,11 +136,12 @@ func (j *logProcessorJob) Init() error {
 	return nil
 }
 
-func (j *logProcessorJob) Run() (result Result, err error) {
+func (j *logProcessorJob) Run(ctx context.Context) (result Result, err error) {
+	j.ctx = ctx
+	j.jobErrors = nil
 
 	var plogs s3.ProcessedLogs // Tracks logs we've already seen
-	var eConf s3.Environment
-	eConf.Get()
+	eConf := appConfig.Environment()
 	s3LogConf := s3.LogConfig{
 		LoadFrom:     eConf.LoadFrom,
 		LoadURL:      eConf.EventBridgePlogsURL,
@@ -92,17 +149,25 @@ func (j *logProcessorJob) Run() (result Result, err error) {
 		PlogConfigID: j.Log.PlogConfigID,
 	}
 	_log := j.Log
+	if _log.Name == "" {
+		return j.failed(errNoLog)
+	}
 
 	switch _log.LogFormat {
 	case s3.S3:
 		loglines, err := s3.ParseS3(_log.Location)
 		if err != nil {
 			fmt.Printf("Parse failed with error: %v\n", err)
+			return j.failed(err)
 		}
 
 		filter := _log.Filter
 
 		for _, eventData := range loglines {
+			if j.ctx.Err() != nil {
+				return j.stopped(j.ctx)
+			}
+
 			// Parse operation field and skip if filer doesn't match
 			opt := eventData.GetOperation()
 			if !opt.FilterLine(eventData, filter) {
@@ -112,23 +177,28 @@ func (j *logProcessorJob) Run() (result Result, err error) {
 			postBody := bytes.NewBuffer(eventBytes)
 			fmt.Println(string(eventBytes))
 
-			resp, err := http.Post(
+			req, err := http.NewRequestWithContext(j.ctx, "POST",
 				"http://"+
 					_log.Webhook.Host+eConf.K8SService+":"+
 					_log.Webhook.Port+
 					"/"+_log.Webhook.Name,
-				"application/json",
 				postBody)
+			if err != nil {
+				return j.failed(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
 
+			resp, err := j.client.Do(req)
+			if j.ctx.Err() != nil {
+				return j.stopped(j.ctx)
+			}
 			if err != nil {
 				log.Printf("HTTP POST failed error %v\n", err)
-				jrsp := &logResult{}
-				return jrsp.LogErrorResults(j, err)
+				return j.failed(err)
 			}
+			resp.Body.Close()
 			if resp.StatusCode != 200 {
-				err := fmt.Errorf("HTTP POST failed non 200%v\n", resp.StatusCode)
-				jrsp := &logResult{}
-				return jrsp.LogErrorResults(j, err)
+				return j.failed(&webhookStatusError{status: resp.StatusCode})
 			}
 		}
 
@@ -160,8 +230,14 @@ func (j *logProcessorJob) Run() (result Result, err error) {
 		fmt.Println("Marshal result for job failed: ", jd)
 	}
 
+	// The log is passed on to workflow steps that follow this one
+	payload, err := json.Marshal(_log)
+	if err != nil {
+		log.Printf("Job: %v marshal log failed: %v\n", j.ID(), err)
+	}
+
 	jrsp := &logResult{job: jd,
-		payload: nil,
+		payload: payload,
 		jobType: j.JobType}
 
 	return jrsp, nil
@@ -169,6 +245,35 @@ func (j *logProcessorJob) Run() (result Result, err error) {
 	//	return nil, nil
 }
 
+// SetInput processes the log passed on by the workflow step that
+// triggered j, in place of the one in its params
+func (j *logProcessorJob) SetInput(step string, payload []byte) {
+	var item s3.LogQueueItem
+	if err := json.Unmarshal(payload, &item); err != nil || item.Name == "" {
+		log.Printf("Job: %v no log in the payload of step %v\n", j.ID(), step)
+		return
+	}
+	j.Log = item
+}
+
+// failed ends a run that hit err, it is kept for Errors with the
+// log being processed
+func (j *logProcessorJob) failed(err error) (result Result, e error) {
+	j.jobErrors = append(j.jobErrors, newJobError(err, j.Log.ID, j.Log.Bucket, j.Log.Name))
+	jrsp := &logResult{}
+	return jrsp.LogErrorResults(j, err)
+}
+
+// stopped ends a run whose context is done
+func (j *logProcessorJob) stopped(ctx context.Context) (result Result, err error) {
+	if ctx.Err() == context.DeadlineExceeded {
+		j.Stats.RequestTimedOut = true
+	}
+	log.Printf("Job: %v stopped: %v\n", j.ID(), ctx.Err())
+	jrsp := &logResult{}
+	return jrsp.LogErrorResults(j, ctx.Err())
+}
+
 // buildMetadata returns a map of strings with an http.Response encoded
 func (j *logProcessorJob) buildMetadata(resp *http.Response) map[string]string {
 	md := make(map[string]string)
@@ -203,6 +308,14 @@ func (j *logProcessorJob) newJob(url url.URL) logProcessorJob {
 	return newJob
 }
 
+// runCopy returns a copy for one scheduled run with its stats reset
+func (j *logProcessorJob) runCopy(js jobSchedule) Job {
+	cp := *j
+	cp.Stats = httpStats{}
+	cp.jobErrors = nil
+	return &cp
+}
+
 func (j *logProcessorJob) Pause() (status string, err error) {
 	return "paused", nil
 }
@@ -212,8 +325,7 @@ func (j *logProcessorJob) Shutdown() error {
 }
 
 func (j *logProcessorJob) Errors() []error {
-	return nil
-
+	return j.jobErrors
 }
 
 func (j *logProcessorJob) Metrics() []byte {
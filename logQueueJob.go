@@ -5,11 +5,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 
 	"log"
 	"net/url"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -23,16 +26,50 @@ const (
 	LogQueueJobType string = "io.pavedraod.eventbridge.logQueueJob"
 )
 
+// logQueueJobSchema for the params a sweep is created with, all
+// customers and buckets are swept when none are given
+const logQueueJobSchema string = `{
+	"type": "object",
+	"properties": {
+		"customer_id": {"type": "string", "format": "uuid",
+			"description": "Only sweep this customer"},
+		"bucket": {"type": "string",
+			"description": "Only sweep this bucket"},
+		"prefix": {"type": "string",
+			"description": "Only list objects starting with this prefix"}
+	},
+	"additionalProperties": false
+}`
+
+func init() {
+	RegisterJobType(LogQueueJobType, func() Job { return &logQueueJob{} })
+	RegisterJobSchema(LogQueueJobType, logQueueJobSchema)
+}
+
 type logQueueJob struct {
-	JobID            uuid.UUID     `json:"jobID"`
-	Payload          []byte        `json:"payload"`
-	JobType          string        `json:"jobType"`
-	customers        s3.Customer   `json:"customers"`
-	s3Client         *minio.Client `json:"s3Client"`
-	schedulerJobChan chan Job      `json:"schedulerJobChan"`
-
-	// TODO: FIX to errors or custom errors
-	jobErrors []string      `json:"jobErrors"`
+	JobID            uuid.UUID `json:"jobID"`
+	Payload          []byte    `json:"payload"`
+	JobType          string    `json:"jobType"`
+	customers        s3.Customer
+	s3Client         *minio.Client
+	schedulerJobChan chan Job
+
+	// PriorityClass high, normal, or low
+	PriorityClass string `json:"priority,omitempty"`
+
+	// Optional filters limiting what a sweep lists
+	CustomerID string `json:"customer_id,omitempty"`
+	Bucket     string `json:"bucket,omitempty"`
+	Prefix     string `json:"prefix,omitempty"`
+
+	// Inputs are the logs workflow steps passed on, the sweep is
+	// limited to their customers and buckets
+	Inputs    []s3.LogQueueItem `json:"inputs,omitempty"`
+	hasInputs bool
+
+	// Errors from the last run, one customer's errors don't
+	// stop the others being swept
+	jobErrors []error
 	Stats     logQueueStats `json:"stats"`
 }
 
@@ -51,11 +88,34 @@ func (j *logQueueJob) Type() string {
 	return LogQueueJobType
 }
 
+// Priority returns the class the dispatcher queues this job in
+func (j *logQueueJob) Priority() string {
+	return j.PriorityClass
+}
+
 func (j *logQueueJob) InitWithJobChan(job chan Job) error {
-	j.schedulerJobChan = job
+	j.setJobChan(job)
 	return j.Init()
 }
 
+// jobChanMux guards schedulerJobChan, the scheduler replaces it when
+// the job channel is resized
+var jobChanMux sync.Mutex
+
+// jobChan returns the channel to send jobs on
+func (j *logQueueJob) jobChan() chan Job {
+	jobChanMux.Lock()
+	defer jobChanMux.Unlock()
+	return j.schedulerJobChan
+}
+
+// setJobChan sets the channel to send jobs on
+func (j *logQueueJob) setJobChan(job chan Job) {
+	jobChanMux.Lock()
+	defer jobChanMux.Unlock()
+	j.schedulerJobChan = job
+}
+
 func (j *logQueueJob) Init() error {
 
 	// Generate UUID
@@ -67,35 +127,45 @@ func (j *logQueueJob) Init() error {
 	return nil
 }
 
-func (j *logQueueJob) Run() (result Result, err error) {
-	c := s3.Customer{}
-	var customers []s3.Customer
-	var eConf Environment
-	eConf.get()
+func (j *logQueueJob) Run(ctx context.Context) (result Result, err error) {
+	// Cached configuration, reloaded on SIGHUP
+	eConf := appConfig.Environment()
+	j.jobErrors = nil
 
-	if eConf.LoadFrom == "disk" {
-		customers, err = c.LoadFromDisk("customer.yaml")
-		if err != nil {
-			log.Fatalf("fail loading customer.yaml: %v\n", err)
-		}
-	} else {
-		// Load from network
-		customers, err = c.LoadFromNetwork(eConf.EventBridgeConfigURL)
-		if err != nil {
-			log.Fatalf("fail loading customer.yaml: %v\n", err)
-		}
+	customers, err := appConfig.Customers()
+	if err != nil {
+		log.Printf("fail loading customer.yaml: %v\n", err)
+		j.jobErrors = append(j.jobErrors, newJobError(err, "", "", ""))
+		jrsp := &logResult{}
+		return jrsp.LogErrorResults(j, err)
+	}
+	if eConf.LoadFrom != loadFromDisk {
 		fmt.Printf("Found %d customers\n", len(customers))
 	}
 
 	opts := minio.ListObjectsOptions{
 		Recursive: true,
-		Prefix:    "",
+		Prefix:    j.Prefix,
 	}
 
 	var logQueue []s3.LogQueueItem
 	var plogs s3.ProcessedLogs
+	swept := 0 // customers swept without errors
 
+sweep:
 	for _, c := range customers {
+		if ctx.Err() != nil {
+			return j.stopped(ctx)
+		}
+
+		if j.CustomerID != "" && c.ID.String() != j.CustomerID {
+			continue
+		}
+		if !j.inputMatches(c.ID.String(), "") {
+			continue
+		}
+		failedBefore := len(j.jobErrors)
+
 		// Load a list of previously processed logs
 		// For now ignore error if not found
 		pconf := s3.LogConfig{
@@ -116,22 +186,37 @@ func (j *logQueueJob) Run() (result Result, err error) {
 
 		// Actually buckets not logs
 		for i, l := range c.Logs {
+			if j.Bucket != "" && l.Name != j.Bucket {
+				continue
+			}
+			if !j.inputMatches(c.ID.String(), l.Name) {
+				continue
+			}
+
 			p, err := plist.Lookup(l.Provider)
 			if err != nil {
-				log.Printf("Provider not found: %v\n", err)
+				j.customerError(c, l.Name, "", err)
 				continue
 			}
 
 			s3Client, err := s3.NewClient(p)
 			if err != nil {
-				log.Fatalln(err)
+				j.customerError(c, l.Name, "", err)
+				continue
+			}
+			objects, err := s3.ListBucketObjectsWithContext(ctx, s3Client, l.Name, opts)
+			if ctx.Err() != nil {
+				return j.stopped(ctx)
 			}
-			objects, err := s3.ListBucketObjects(s3Client, l.Name, opts)
 			if err != nil {
-				log.Fatalln(err)
+				j.customerError(c, l.Name, "", err)
+				continue
 			}
 
 			for _, o := range objects {
+				if ctx.Err() != nil {
+					return j.stopped(ctx)
+				}
 
 				// See it is already processed
 				//
@@ -141,10 +226,13 @@ func (j *logQueueJob) Run() (result Result, err error) {
 
 				/// create new stats object
 				j.Stats.RequestStartTime = time.Now()
-				f, err := s3.GetObject(s3Client, l.Name, o.Key, minio.GetObjectOptions{})
+				f, err := s3.GetObjectWithContext(ctx, s3Client, l.Name, o.Key, minio.GetObjectOptions{})
+				if ctx.Err() != nil {
+					return j.stopped(ctx)
+				}
 				if err != nil {
-					j.Stats.RequestTimedOut = true
-					log.Fatalln(err)
+					j.customerError(c, l.Name, o.Key, err)
+					continue
 				}
 
 				c.Configuration.Hook.Host = eConf.EventBridgePostHost
@@ -173,13 +261,40 @@ func (j *logQueueJob) Run() (result Result, err error) {
 				nj.Init()
 				nj.Log = item
 
+				// Customers can override the sweep's priority
+				nj.PriorityClass = j.PriorityClass
+				if c.Configuration.Priority != "" {
+					nj.PriorityClass = c.Configuration.Priority
+				}
+				nj.MaxInFlight = c.Configuration.MaxConcurrentJobs
+
 				j.Stats.RequestTime = time.Now().Sub(j.Stats.RequestStartTime)
-				j.schedulerJobChan <- nj
+				if err := j.submit(ctx, nj); err != nil {
+					// No job will process the download
+					if e := os.Remove(f); e != nil {
+						log.Printf("Failed to remove %s error %v\n", f, e)
+					}
+					if ctx.Err() != nil {
+						return j.stopped(ctx)
+					}
+					if err != errSubmitBackpressure {
+						return nil, err
+					}
+
+					// The queue is full, the next sweep downloads
+					// and queues the rest
+					j.customerError(c, l.Name, o.Key, err)
+					break sweep
+				}
 
 				logQueue = append(logQueue, item)
 			}
 		}
 
+		if len(j.jobErrors) == failedBefore {
+			swept++
+		}
+
 		/*
 			if eConf.LoadFrom == s3.NETWORK {
 				fmt.Println("plots save: ", plogs)
@@ -193,7 +308,7 @@ func (j *logQueueJob) Run() (result Result, err error) {
 
 	payload, err := json.Marshal(logQueue)
 	if err != nil {
-		fmt.Errorf("Error %v\n", err)
+		log.Printf("Job: %v marshal queued logs failed: %v\n", j.ID(), err)
 		return nil, err
 	}
 
@@ -206,9 +321,83 @@ func (j *logQueueJob) Run() (result Result, err error) {
 		jobType: j.Type(),
 		payload: payload}
 
+	// The sweep fails only if no customer could be swept, otherwise
+	// the logs queued for the others are in the payload
+	if len(j.jobErrors) > 0 && swept == 0 {
+		return jrsp.LogErrorResults(j, j.jobErrors[0])
+	}
+	if len(j.jobErrors) > 0 {
+		return jrsp.LogPartialResults(j)
+	}
+
 	return jrsp, nil
 }
 
+// SetInput limits the sweep to the customers and buckets of the logs
+// passed on by a workflow step, a list from another sweep or the one
+// a log download processed
+func (j *logQueueJob) SetInput(step string, payload []byte) {
+	var items []s3.LogQueueItem
+	if err := json.Unmarshal(payload, &items); err != nil {
+		var item s3.LogQueueItem
+		if err := json.Unmarshal(payload, &item); err != nil {
+			log.Printf("Job: %v no logs in the payload of step %v\n", j.ID(), step)
+			return
+		}
+		items = append(items, item)
+	}
+	j.Inputs = append(j.Inputs, items...)
+	j.hasInputs = true
+}
+
+// inputMatches is true if customer, and bucket unless it is empty,
+// are in the inputs or the sweep has none
+func (j *logQueueJob) inputMatches(customer, bucket string) bool {
+	if !j.hasInputs {
+		return true
+	}
+	for _, in := range j.Inputs {
+		if in.ID == customer && (bucket == "" || in.Bucket == bucket) {
+			return true
+		}
+	}
+	return false
+}
+
+// customerError records err for customer c, the sweep carries on
+// with c's other logs and the other customers
+func (j *logQueueJob) customerError(c s3.Customer, bucket, object string, err error) {
+	log.Printf("Job: %v customer %v: %v\n", j.ID(), c.ID, err)
+	j.jobErrors = append(j.jobErrors, newJobError(fmt.Errorf("customer %v: %w", c.ID, err),
+		c.ID.String(), bucket, object))
+}
+
+// submit queues nj as a child of this sweep without blocking the
+// worker, it returns errSubmitBackpressure if the queue is full.
+// Sending on the scheduler's channel from a worker can deadlock once
+// it fills, so it is only used when the job isn't run by a dispatcher.
+func (j *logQueueJob) submit(ctx context.Context, nj Job) error {
+	if s := SubmitterFromContext(ctx); s != nil {
+		return s.Submit(nj)
+	}
+
+	select {
+	case j.jobChan() <- nj:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stopped ends a run whose context is done
+func (j *logQueueJob) stopped(ctx context.Context) (result Result, err error) {
+	if ctx.Err() == context.DeadlineExceeded {
+		j.Stats.RequestTimedOut = true
+	}
+	log.Printf("Job: %v stopped: %v\n", j.ID(), ctx.Err())
+	return nil, ctx.Err()
+}
+
 func (j *logQueueJob) newJob(url url.URL) logQueueJob {
 	newJob := logQueueJob{}
 	// Set type and ID and http.Client
@@ -216,6 +405,20 @@ func (j *logQueueJob) newJob(url url.URL) logQueueJob {
 	return newJob
 }
 
+// runCopy returns a copy for one run of js with its stats reset,
+// the jobs it sends inherit the schedule's priority
+func (j *logQueueJob) runCopy(js jobSchedule) Job {
+	jobChanMux.Lock()
+	cp := *j
+	jobChanMux.Unlock()
+	cp.Stats = logQueueStats{}
+	cp.jobErrors = nil
+	if js.Priority != "" {
+		cp.PriorityClass = js.Priority
+	}
+	return &cp
+}
+
 func (j *logQueueJob) Pause() (status string, err error) {
 	return "paused", nil
 }
@@ -225,8 +428,7 @@ func (j *logQueueJob) Shutdown() error {
 }
 
 func (j *logQueueJob) Errors() []error {
-	return nil
-
+	return j.jobErrors
 }
 
 func (j *logQueueJob) Metrics() []byte {
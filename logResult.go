@@ -2,7 +2,6 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
 )
 
 // Result for a given job
@@ -17,25 +16,18 @@ func (r *logResult) Job() []byte {
 	return r.job
 }
 
+// Decode returns the job the result is for using the factory
+// registered for its type
 func (r *logResult) Decode() (Job, error) {
-	if r.jobType == LogQueueJobType {
-		jd := &logQueueJob{}
-		err := json.Unmarshal(r.job, jd)
-		if err != nil {
-			return jd, nil
-		}
-		return nil, err
-	} else if r.jobType == LogProcessorJobType {
-		jd := &logProcessorJob{}
-		err := json.Unmarshal(r.job, jd)
-		if err != nil {
-			return jd, nil
-		}
+	jd, err := newJobOfType(r.jobType)
+	if err != nil {
 		return nil, err
 	}
 
-	ne := fmt.Errorf("Unknown job type: %v", r.jobType)
-	return nil, ne
+	if err := json.Unmarshal(r.job, jd); err != nil {
+		return nil, err
+	}
+	return jd, nil
 }
 
 // LogErrorResults generic handler for errors while
@@ -48,6 +40,13 @@ func (r *logResult) LogErrorResults(job interface{}, callingerror error) (Result
 
 	md["original_error"] = callingerror.Error()
 
+	r.metaData = md
+
+	// Every error the job recorded, not just the one it stopped on
+	if j, ok := job.(Job); ok {
+		addErrorMetaData(r, collectErrors(j, callingerror))
+	}
+
 	jobD, err := json.Marshal(job)
 	if err != nil {
 		md["marshal_error"] = "Failed to marshal job data"
@@ -58,16 +57,30 @@ func (r *logResult) LogErrorResults(job interface{}, callingerror error) (Result
 	} else {
 		r.jobType = job.(Job).Type()
 	}
-	r.metaData = md
 	r.job = jobD
 
 	return r, nil
 }
 
+// LogPartialResults for a job that finished with errors in part of
+// its work, the result succeeds and carries them in job_errors
+func (r *logResult) LogPartialResults(job Job) (Result, error) {
+	r.AddMetaData(metaDataPartial, "true")
+	addErrorMetaData(r, collectErrors(job, nil))
+	return r, nil
+}
+
 func (r *logResult) MetaData() map[string]string {
 	return r.metaData
 }
 
+func (r *logResult) AddMetaData(key, value string) {
+	if r.metaData == nil {
+		r.metaData = make(map[string]string)
+	}
+	r.metaData[key] = value
+}
+
 func (r *logResult) Payload() []byte {
 	return r.payload
 }
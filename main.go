@@ -51,6 +51,15 @@ const (
 
 	// EventbridgeSchedulerEndPoint
 	EventbridgeSchedulerEndPoint string = "scheduler"
+
+	// EventbridgeDeadLetterEndPoint under EventbridgeJobsEndPoint
+	EventbridgeDeadLetterEndPoint string = "deadletters"
+
+	// EventbridgeJobTypesEndPoint under EventbridgeJobsEndPoint
+	EventbridgeJobTypesEndPoint string = "types"
+
+	// EventbridgeWorkflowsEndPoint
+	EventbridgeWorkflowsEndPoint string = "workflows"
 )
 
 // EventbridgeApp Top level construct containing building blocks
@@ -71,7 +80,8 @@ type EventbridgeApp struct {
 	// Ready once dispatcher has complete initialization
 	Ready bool
 
-	httpInterruptChan chan os.Signal
+	// signalChan receives SIGTERM, SIGINT and SIGHUP
+	signalChan chan os.Signal
 
 	// Logs
 	accessLog *os.File
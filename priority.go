@@ -0,0 +1,292 @@
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root
+// for full license information.
+//
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// Priority classes, jobs without one are normal
+const (
+	priorityHigh   = "high"
+	priorityNormal = "normal"
+	priorityLow    = "low"
+)
+
+// priorityClasses in the order ties are broken
+var priorityClasses = []string{priorityHigh, priorityNormal, priorityLow}
+
+// defaultPriorityWeights share of dispatches each class gets when
+// all of them have work queued
+var defaultPriorityWeights = map[string]int{
+	priorityHigh:   6,
+	priorityNormal: 3,
+	priorityLow:    1,
+}
+
+// Management API
+const priorityWeightPrefix string = "priority_weight:"
+
+// Metrics constants, the class name is appended
+const dispatcherQueueDepth = "queue_depth_"
+
+// prioritizedJob is implemented by jobs that set a priority class
+type prioritizedJob interface {
+	Priority() string
+}
+
+// validPriority is true for known classes and empty
+func validPriority(p string) bool {
+	if p == "" {
+		return true
+	}
+	_, ok := defaultPriorityWeights[p]
+	return ok
+}
+
+// jobPriority returns the class j is queued in
+func jobPriority(j Job) string {
+	pj, ok := j.(prioritizedJob)
+	if !ok || pj.Priority() == "" {
+		return priorityNormal
+	}
+
+	p := pj.Priority()
+	if !validPriority(p) {
+		log.Printf("Job: %v unknown priority %q, using %s\n", j.ID(), p, priorityNormal)
+		return priorityNormal
+	}
+	return p
+}
+
+// priorityQueues hold jobs waiting for a worker, one tenantQueue per
+// class.  Pop uses smooth weighted round robin across classes so every
+// class is served and low priority work doesn't starve, then round
+// robin across the tenants in the class that are under their limit.
+type priorityQueues struct {
+	d        *dispatcher
+	queues   map[string]*tenantQueue
+	weights  map[string]int
+	current  map[string]int // running credit per class
+	inFlight map[string]int // by tenant, popped and not Done
+	limits   map[string]int // by tenant, latest seen on a job
+	popped   map[string]int // by job ID, jobs Done must release
+	maxIn    int            // tenant_max_in_flight
+	ready    chan bool      // wakes the Forwarder
+	mux      *sync.Mutex
+}
+
+// Init sets defaults
+func (pq *priorityQueues) Init(d *dispatcher) {
+	pq.d = d
+	pq.mux = &sync.Mutex{}
+	pq.ready = make(chan bool, 1)
+	pq.maxIn = TenantMaxInFlight
+	pq.queues = make(map[string]*tenantQueue)
+	pq.weights = make(map[string]int)
+	pq.current = make(map[string]int)
+	pq.inFlight = make(map[string]int)
+	pq.limits = make(map[string]int)
+	pq.popped = make(map[string]int)
+	for c, w := range defaultPriorityWeights {
+		pq.queues[c] = newTenantQueue()
+		pq.weights[c] = w
+		d.MetricSet(dispatcherQueueDepth+c, 0)
+	}
+}
+
+// Fields returns the management fields the queues handle
+func (pq *priorityQueues) Fields() []string {
+	var fields []string
+	for _, c := range priorityClasses {
+		fields = append(fields, priorityWeightPrefix+c)
+	}
+	return append(fields, tenantMaxInFlight)
+}
+
+// Handles is true for fields SetConfigVariable accepts
+func (pq *priorityQueues) Handles(name string) bool {
+	return strings.HasPrefix(name, priorityWeightPrefix) ||
+		name == tenantMaxInFlight
+}
+
+// SetConfigVariable changes the weight of a class or the
+// default tenant limit
+func (pq *priorityQueues) SetConfigVariable(name string, value int) (msg []byte, err error) {
+	var rmsg string
+	var old int
+
+	if name == tenantMaxInFlight {
+		if value < 0 {
+			rmsg = fmt.Sprintf("{\"Status\": \"%s must be 0 or more\"}", name)
+			return []byte(rmsg), errors.New("invalid tenant limit")
+		}
+
+		pq.mux.Lock()
+		old = pq.maxIn
+		pq.maxIn = value
+		pq.mux.Unlock()
+		pq.wake()
+	} else {
+		class := strings.TrimPrefix(name, priorityWeightPrefix)
+		if class == "" || !validPriority(class) || value < 1 {
+			rmsg = fmt.Sprintf("{\"Status\": \"%s needs a class of %s and a value greater than 0\"}",
+				name, strings.Join(priorityClasses, ", "))
+			return []byte(rmsg), errors.New("invalid priority weight")
+		}
+
+		pq.mux.Lock()
+		old = pq.weights[class]
+		pq.weights[class] = value
+		pq.mux.Unlock()
+	}
+
+	rmsg = fmt.Sprintf("{\"Status\": \"%s changed from %d to %d\"}",
+		name, old, value)
+	return []byte(rmsg), nil
+}
+
+// wake tells the Forwarder a job may be ready without blocking
+func (pq *priorityQueues) wake() {
+	select {
+	case pq.ready <- true:
+	default:
+	}
+}
+
+// mayRun is true if tenant is under its limit, the caller holds pq.mux
+func (pq *priorityQueues) mayRun(tenant string) bool {
+	if tenant == "" {
+		return true
+	}
+
+	limit := pq.limits[tenant]
+	if limit == 0 {
+		limit = pq.maxIn
+	}
+	return limit == 0 || pq.inFlight[tenant] < limit
+}
+
+// Push queues j in its class
+func (pq *priorityQueues) Push(j Job) {
+	c := jobPriority(j)
+	tenant, limit := jobTenant(j)
+
+	pq.mux.Lock()
+	if tenant != "" {
+		pq.limits[tenant] = limit
+	}
+	q := pq.queues[c]
+	q.push(tenant, j)
+	n := q.size
+	pq.mux.Unlock()
+
+	pq.d.MetricSet(dispatcherQueueDepth+c, n)
+	pq.wake()
+}
+
+// Pop removes the next job to run, nil if no queued job may run.
+// Done must be called once the job has run.
+func (pq *priorityQueues) Pop() Job {
+	pq.mux.Lock()
+
+	// Classes with work earn their weight, the richest is served
+	// and pays back the total so others catch up
+	total := 0
+	best := ""
+	next := make(map[string]int)
+	for _, c := range priorityClasses {
+		n := pq.queues[c].eligible(pq.mayRun)
+		if n < 0 {
+			continue
+		}
+		next[c] = n
+		pq.current[c] += pq.weights[c]
+		total += pq.weights[c]
+		if best == "" || pq.current[c] > pq.current[best] {
+			best = c
+		}
+	}
+
+	if best == "" {
+		pq.mux.Unlock()
+		return nil
+	}
+	pq.current[best] -= total
+
+	q := pq.queues[best]
+	j, tenant := q.pop(next[best])
+	depth := q.size
+
+	// Idle classes don't bank credit
+	if depth == 0 {
+		pq.current[best] = 0
+	}
+
+	pq.popped[j.ID()]++
+	pq.inFlight[tenant]++
+	running := pq.inFlight[tenant]
+	pq.mux.Unlock()
+
+	pq.d.MetricSet(dispatcherQueueDepth+best, depth)
+	pq.d.MetricSetTenantInFlight(tenant, running)
+	return j
+}
+
+// Done releases the tenant slot held by j once it has run
+func (pq *priorityQueues) Done(j Job) {
+	tenant, _ := jobTenant(j)
+
+	pq.mux.Lock()
+	if pq.popped[j.ID()] == 0 {
+		// Never queued, sent straight to a worker
+		pq.mux.Unlock()
+		return
+	}
+	if pq.popped[j.ID()]--; pq.popped[j.ID()] == 0 {
+		delete(pq.popped, j.ID())
+	}
+	pq.inFlight[tenant]--
+	running := pq.inFlight[tenant]
+	if running == 0 {
+		delete(pq.inFlight, tenant)
+	}
+	pq.mux.Unlock()
+
+	pq.d.MetricSetTenantInFlight(tenant, running)
+	pq.wake()
+}
+
+// Len returns the number of jobs queued in every class
+func (pq *priorityQueues) Len() int {
+	pq.mux.Lock()
+	defer pq.mux.Unlock()
+
+	n := 0
+	for _, q := range pq.queues {
+		n += q.size
+	}
+	return n
+}
+
+// Drain empties every queue returning the jobs removed
+func (pq *priorityQueues) Drain() []Job {
+	pq.mux.Lock()
+	var jobs []Job
+	for _, c := range priorityClasses {
+		jobs = append(jobs, pq.queues[c].drain()...)
+		pq.current[c] = 0
+	}
+	pq.mux.Unlock()
+
+	for _, c := range priorityClasses {
+		pq.d.MetricSet(dispatcherQueueDepth+c, 0)
+	}
+	return jobs
+}
@@ -11,6 +11,9 @@ type Result interface {
 	// Return the header/message headers
 	MetaData() map[string]string
 
+	// Add a header/message header
+	AddMetaData(key, value string)
+
 	// Return the payload/response data
 	Payload() []byte
 }
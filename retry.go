@@ -0,0 +1,267 @@
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root
+// for full license information.
+//
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for retries
+const (
+	// RetryInitialBackoff milliseconds before the first retry
+	RetryInitialBackoff int = 1000
+
+	// RetryMaxBackoff milliseconds, the backoff doubles up to this
+	RetryMaxBackoff int = 60000
+
+	// RetryMaxAttempts for job types without their own setting
+	// including the first run, 1 disables retries
+	RetryMaxAttempts int = 1
+)
+
+// defaultMaxAttempts per job type, the scheduler already reruns
+// logQueueJobs so only failed webhook posts are retried
+var defaultMaxAttempts = map[string]int{
+	LogQueueJobType:     1,
+	LogProcessorJobType: 3,
+}
+
+// Management API
+const (
+	retryInitialBackoffMS  string = "retry_initial_backoff_ms"
+	retryMaxBackoffMS      string = "retry_max_backoff_ms"
+	retryMaxAttemptsPrefix string = "retry_max_attempts:"
+)
+
+// Metrics constants
+const (
+	dispatcherJobRetries     = "job_retries"
+	dispatcherRetryExhausted = "job_retries_exhausted"
+	dispatcherRetriesPending = "job_retries_pending"
+)
+
+// Result metadata keys
+const (
+	metaDataAttempt     = "attempt"
+	metaDataMaxAttempts = "max_attempts"
+)
+
+// retrier re-queues failed jobs after an exponential backoff
+type retrier struct {
+	d              *dispatcher
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	maxAttempts    map[string]int // by job type
+	attempts       map[string]int // by job ID, jobs being retried
+	pending        int            // waiting out a backoff
+	mux            *sync.Mutex
+}
+
+// Init sets defaults
+func (rt *retrier) Init(d *dispatcher) {
+	rt.d = d
+	rt.mux = &sync.Mutex{}
+	rt.initialBackoff = time.Duration(RetryInitialBackoff) * time.Millisecond
+	rt.maxBackoff = time.Duration(RetryMaxBackoff) * time.Millisecond
+	rt.attempts = make(map[string]int)
+	rt.maxAttempts = make(map[string]int)
+	for t, n := range defaultMaxAttempts {
+		rt.maxAttempts[t] = n
+	}
+}
+
+// Fields returns the management fields the retrier handles
+func (rt *retrier) Fields() []string {
+	return []string{
+		retryInitialBackoffMS,
+		retryMaxBackoffMS,
+		retryMaxAttemptsPrefix + LogQueueJobType,
+		retryMaxAttemptsPrefix + LogProcessorJobType}
+}
+
+// Handles is true for fields SetConfigVariable accepts
+func (rt *retrier) Handles(name string) bool {
+	return name == retryInitialBackoffMS ||
+		name == retryMaxBackoffMS ||
+		strings.HasPrefix(name, retryMaxAttemptsPrefix)
+}
+
+// SetConfigVariable changes the value of a retry field
+func (rt *retrier) SetConfigVariable(name string, value int) (msg []byte, err error) {
+	var rmsg string
+	var old int
+
+	rt.mux.Lock()
+	defer rt.mux.Unlock()
+
+	switch {
+	case name == retryInitialBackoffMS:
+		if value < 1 || value > int(rt.maxBackoff.Milliseconds()) {
+			rmsg = fmt.Sprintf("{\"Status\": \"%s must be between 1 and %d\"}",
+				name, rt.maxBackoff.Milliseconds())
+			return []byte(rmsg), errors.New("invalid backoff")
+		}
+		old = int(rt.initialBackoff.Milliseconds())
+		rt.initialBackoff = time.Duration(value) * time.Millisecond
+
+	case name == retryMaxBackoffMS:
+		if value < int(rt.initialBackoff.Milliseconds()) {
+			rmsg = fmt.Sprintf("{\"Status\": \"%s must be at least %d\"}",
+				name, rt.initialBackoff.Milliseconds())
+			return []byte(rmsg), errors.New("invalid backoff")
+		}
+		old = int(rt.maxBackoff.Milliseconds())
+		rt.maxBackoff = time.Duration(value) * time.Millisecond
+
+	case strings.HasPrefix(name, retryMaxAttemptsPrefix):
+		jobType := strings.TrimPrefix(name, retryMaxAttemptsPrefix)
+		if jobType == "" || value < 1 {
+			rmsg = fmt.Sprintf("{\"Status\": \"%s needs a job type and a value greater than 0\"}", name)
+			return []byte(rmsg), errors.New("invalid max attempts")
+		}
+		old = rt.maxFor(jobType)
+		rt.maxAttempts[jobType] = value
+
+	default:
+		rmsg = fmt.Sprintf("{\"Status\": \"%s unknown\"}", name)
+		return []byte(rmsg), errors.New("unknown set field")
+	}
+
+	rmsg = fmt.Sprintf("{\"Status\": \"%s changed from %d to %d\"}",
+		name, old, value)
+	return []byte(rmsg), nil
+}
+
+// maxFor returns max attempts for jobType, the caller holds rt.mux
+func (rt *retrier) maxFor(jobType string) int {
+	if n, ok := rt.maxAttempts[jobType]; ok {
+		return n
+	}
+	return RetryMaxAttempts
+}
+
+// Attempt counts a run of j returning the attempt number
+// and the maximum attempts for its type
+func (rt *retrier) Attempt(j Job) (attempt, max int) {
+	rt.mux.Lock()
+	defer rt.mux.Unlock()
+
+	rt.attempts[j.ID()]++
+	return rt.attempts[j.ID()], rt.maxFor(j.Type())
+}
+
+// Done forgets j once it succeeds or runs out of attempts
+func (rt *retrier) Done(j Job) {
+	rt.mux.Lock()
+	delete(rt.attempts, j.ID())
+	rt.mux.Unlock()
+}
+
+// backoff for the retry after attempt, doubling from initialBackoff
+// up to maxBackoff with jitter of up to half the delay
+func (rt *retrier) backoff(attempt int) time.Duration {
+	rt.mux.Lock()
+	delay := rt.initialBackoff
+	max := rt.maxBackoff
+	rt.mux.Unlock()
+
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// Retry re-queues j after a backoff without blocking the caller
+// Retries wait in the priority queues like new jobs
+func (rt *retrier) Retry(j Job, attempt int, cause error) {
+	delay := rt.backoff(attempt)
+	log.Printf("Job: %v attempt %d failed: %v, retrying in %v\n",
+		j.ID(), attempt, cause, delay)
+
+	rt.mux.Lock()
+	rt.pending++
+	rt.d.MetricSet(dispatcherRetriesPending, rt.pending)
+	rt.mux.Unlock()
+	rt.d.MetricInc(dispatcherJobRetries)
+
+	go func() {
+		defer func() {
+			rt.mux.Lock()
+			rt.pending--
+			rt.d.MetricSet(dispatcherRetriesPending, rt.pending)
+			rt.mux.Unlock()
+		}()
+
+		select {
+		case <-time.After(delay):
+			rt.d.queues.Push(j)
+		case <-rt.d.ctx.Done():
+		}
+	}()
+}
+
+// Pending returns the number of jobs waiting to be retried
+func (rt *retrier) Pending() int {
+	rt.mux.Lock()
+	defer rt.mux.Unlock()
+	return rt.pending
+}
+
+// jobFailed returns why a run failed or nil if it succeeded
+// Jobs report failures by returning an error, through Errors(),
+// or with a result built by LogErrorResults.  A result built by
+// LogPartialResults succeeded despite its errors.
+func jobFailed(j Job, r Result, e error) error {
+	if e != nil {
+		return e
+	}
+
+	if partialResult(r) {
+		return nil
+	}
+
+	if errs := j.Errors(); len(errs) > 0 {
+		return errs[0]
+	}
+
+	if errs := resultErrors(r); len(errs) > 0 {
+		return &errs[0]
+	}
+
+	if r != nil {
+		if msg, ok := r.MetaData()["original_error"]; ok {
+			return errors.New(msg)
+		}
+	}
+
+	return nil
+}
+
+// jobRetryable is true if running j again could fix the failed run,
+// a sweep is retried if any of its customers could succeed
+func jobRetryable(j Job, r Result, cause error) bool {
+	if errs := resultErrors(r); len(errs) > 0 {
+		return retryable(errs)
+	}
+	return retryable(collectErrors(j, cause))
+}
+
+// attemptMetaData records attempts on the result
+func attemptMetaData(r Result, attempt, max int) {
+	r.AddMetaData(metaDataAttempt, strconv.Itoa(attempt))
+	r.AddMetaData(metaDataMaxAttempts, strconv.Itoa(max))
+}
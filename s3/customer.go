@@ -69,19 +69,20 @@ func (c *Customer) LoadFromDisk(file string) ([]Customer, error) {
 	f, err := os.Open(file)
 	if err != nil {
 		log.Println("failed to open:", file, ", error:", err)
+		return nil, fmt.Errorf("%w: %v", ErrCustomerLoad, err)
 	}
 	defer f.Close()
 
-	byteValue, e := ioutil.ReadAll(f)
-	if e != nil {
+	byteValue, err := ioutil.ReadAll(f)
+	if err != nil {
 		log.Println("read failed for ", file)
-		return nil, err
+		return nil, fmt.Errorf("%w: %s: %v", ErrCustomerLoad, file, err)
 	}
 
 	err = yaml.Unmarshal([]byte(byteValue), &cl)
 	if err != nil {
 		log.Println("Unmarshal failed", err)
-		return nil, err
+		return nil, fmt.Errorf("%w: %s: %v", ErrCustomerLoad, file, err)
 	}
 
 	return cl, nil
@@ -95,6 +96,7 @@ func (c *Customer) LoadFromNetwork(url string) ([]Customer, error) {
 	req, err := http.NewRequest("GET", requrl, nil)
 	if err != nil {
 		log.Println("New Request faild", err)
+		return nil, fmt.Errorf("%w: %v", ErrCustomerLoad, err)
 	}
 
 	q := req.URL.Query()
@@ -105,22 +107,29 @@ func (c *Customer) LoadFromNetwork(url string) ([]Customer, error) {
 
 	res, err := http.DefaultClient.Do(req)
 	fmt.Println(res, err)
-	if err != nil || res.StatusCode != 200 {
-		log.Printf("Do failed err: %v \nURL: %v\nBody: %v\n", err, requrl, res)
-		return cl, err
+	if err != nil {
+		log.Printf("Do failed err: %v \nURL: %v\n", err, requrl)
+		return nil, fmt.Errorf("%w: %s: %v", ErrCustomerLoad, requrl, err)
 	}
 
 	defer res.Body.Close()
 
+	// A failed list is not an empty one
+	if res.StatusCode != http.StatusOK {
+		log.Printf("Do failed status: %v \nURL: %v\n", res.StatusCode, requrl)
+		return nil, fmt.Errorf("%w: %s: status %v", ErrCustomerLoad, requrl, res.StatusCode)
+	}
+
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		log.Println("Reading res.Body failed", err)
+		return nil, fmt.Errorf("%w: %s: %v", ErrCustomerLoad, requrl, err)
 	}
 
 	if err := json.Unmarshal(body, &lr); err != nil {
 		fmt.Println("Unmarshall failed: ", err)
 		log.Println("Unmarshall failed: ", err)
-		return cl, err
+		return nil, fmt.Errorf("%w: %s: %v", ErrCustomerLoad, requrl, err)
 	}
 
 	for _, v := range lr {
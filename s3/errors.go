@@ -0,0 +1,26 @@
+package s3
+
+import "errors"
+
+// Errors returned while loading customers and their logs, they are
+// wrapped with details so test for them with errors.Is
+var (
+	// ErrCustomerLoad customer configuration could not be read
+	ErrCustomerLoad = errors.New("customer load failed")
+
+	// ErrProviderNotFound a log names a provider the customer doesn't have
+	ErrProviderNotFound = errors.New("provider not found")
+
+	// ErrClientCreate a client for a provider could not be created
+	ErrClientCreate = errors.New("s3 client create failed")
+
+	// ErrListObjects the objects in a bucket could not be listed
+	ErrListObjects = errors.New("listing bucket objects failed")
+
+	// ErrObjectDownload an object could not be downloaded
+	ErrObjectDownload = errors.New("object download failed")
+
+	// ErrParse a log file could not be read or has a line that
+	// doesn't match its format
+	ErrParse = errors.New("log parse failed")
+)
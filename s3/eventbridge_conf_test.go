@@ -1,7 +1,12 @@
 package s3
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"testing"
 	"time"
 )
@@ -64,3 +69,48 @@ func TestDeleteDeployment(t *testing.T) {
 		}
 	}
 }
+
+func TestTypedErrors(t *testing.T) {
+	ps := Providers{testProvider}
+	if _, err := ps.Lookup("missing"); !errors.Is(err, ErrProviderNotFound) {
+		t.Errorf("Expected %v; Got %v", ErrProviderNotFound, err)
+	}
+
+	if _, err := customer.LoadFromDisk("missing.yaml"); !errors.Is(err, ErrCustomerLoad) {
+		t.Errorf("Expected %v; Got %v", ErrCustomerLoad, err)
+	}
+
+	// A customer service that fails is not one without customers
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	if _, err := customer.LoadFromNetwork(ts.URL + "/"); !errors.Is(err, ErrCustomerLoad) {
+		t.Errorf("Expected %v; Got %v", ErrCustomerLoad, err)
+	}
+	ts.Close()
+	if _, err := customer.LoadFromNetwork(ts.URL + "/"); !errors.Is(err, ErrCustomerLoad) {
+		t.Errorf("Expected %v; Got %v", ErrCustomerLoad, err)
+	}
+
+	if _, err := ParseS3("test/missing"); !errors.Is(err, ErrParse) {
+		t.Errorf("Expected %v; Got %v", ErrParse, err)
+	}
+
+	// Lines after the two header lines must match the format
+	f, err := ioutil.TempFile("", "s3log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("header\nheader\nnot a log line\n")
+	f.Close()
+	if _, err := ParseS3(f.Name()); !errors.Is(err, ErrParse) {
+		t.Errorf("Expected %v; Got %v", ErrParse, err)
+	}
+
+	lines, err := ParseS3("test/pipeline-artifact-logs-pr2021-06-02-01-28-27-V54F6KVN6A7K9F9W-798956451")
+	if err != nil || len(lines) == 0 {
+		t.Errorf("Expected parsed lines; Got %d %v", len(lines), err)
+	}
+}
@@ -2,41 +2,58 @@ package s3
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 
 	"github.com/minio/minio-go/v7"
 )
 
 func GetObject(client *minio.Client, bucket string, object string, opts minio.GetObjectOptions) (file string, er error) {
+	return GetObjectWithContext(context.Background(), client, bucket, object, opts)
+}
+
+// GetObjectWithContext downloads object to a temporary file, the
+// download stops with ctx.Err() if ctx is done first
+func GetObjectWithContext(ctx context.Context, client *minio.Client, bucket string, object string, opts minio.GetObjectOptions) (file string, er error) {
 
 	tmpfile, err := ioutil.TempFile("/tmp/", bucket+"-"+object+"-")
 	if err != nil {
-		log.Fatal(err)
+		return "", fmt.Errorf("%w: %s/%s: %v", ErrObjectDownload, bucket, object, err)
 	}
 
-	reader, err := client.GetObject(context.Background(), bucket, object, minio.GetObjectOptions{})
+	reader, err := client.GetObject(ctx, bucket, object, minio.GetObjectOptions{})
 	if err != nil {
-		log.Fatalln(err)
+		return failed(ctx, tmpfile.Name(), bucket, object, err)
 	}
 	defer reader.Close()
 
 	localFile, err := os.Create(tmpfile.Name())
 	if err != nil {
-		log.Fatalln(err)
+		return failed(ctx, tmpfile.Name(), bucket, object, err)
 	}
 	defer localFile.Close()
 
 	stat, err := reader.Stat()
 	if err != nil {
-		log.Fatalln(err)
+		return failed(ctx, tmpfile.Name(), bucket, object, err)
 	}
 
 	if _, err := io.CopyN(localFile, reader, stat.Size); err != nil {
-		log.Fatalln(err)
+		return failed(ctx, tmpfile.Name(), bucket, object, err)
 	}
 
 	return tmpfile.Name(), nil
 }
+
+// failed removes a partial download and returns ctx.Err() if ctx
+// is done, otherwise err wrapped in ErrObjectDownload
+func failed(ctx context.Context, fn, bucket, object string, err error) (string, error) {
+	os.Remove(fn)
+
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	return "", fmt.Errorf("%w: %s/%s: %v", ErrObjectDownload, bucket, object, err)
+}
@@ -8,13 +8,25 @@ import (
 )
 
 func ListBucketObjects(client *minio.Client, bucket string, opts minio.ListObjectsOptions) (objects []minio.ObjectInfo, err error) {
+	return ListBucketObjectsWithContext(context.Background(), client, bucket, opts)
+}
+
+// ListBucketObjectsWithContext lists objects in bucket returning
+// ctx.Err() if ctx is done first
+func ListBucketObjectsWithContext(ctx context.Context, client *minio.Client, bucket string, opts minio.ListObjectsOptions) (objects []minio.ObjectInfo, err error) {
 
-	for obj := range client.ListObjects(context.Background(), bucket, opts) {
+	for obj := range client.ListObjects(ctx, bucket, opts) {
 		if obj.Err != nil {
-			fmt.Println("getBucketsObjects.go failed with err: ", obj.Err)
-			return nil, nil
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("%w: %s: %v", ErrListObjects, bucket, obj.Err)
 		}
 		objects = append(objects, obj)
 	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 	return objects, nil
 }
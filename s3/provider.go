@@ -29,5 +29,5 @@ func (ps *Providers) Lookup(pName string) (Provider, error) {
 		}
 	}
 
-	return rp, fmt.Errorf("Provider lookup failed for %v\n", pName)
+	return rp, fmt.Errorf("%w: %v", ErrProviderNotFound, pName)
 }
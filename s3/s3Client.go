@@ -1,7 +1,7 @@
 package s3
 
 import (
-	"log"
+	"fmt"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
@@ -13,8 +13,7 @@ func NewClient(p Provider) (*minio.Client, error) {
 		Secure: true,
 	})
 	if err != nil {
-		log.Fatalln(err)
-		return nil, err
+		return nil, fmt.Errorf("%w: %v: %v", ErrClientCreate, p.Name, err)
 	}
 
 	return s3Client, nil
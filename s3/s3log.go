@@ -224,7 +224,7 @@ func ParseS3(file string) ([]S3LogLine, error) {
 
 	lines, err := readLines(file)
 	if err != nil {
-		log.Fatalf("readLines: %s", err)
+		return nil, fmt.Errorf("%w: %s: %v", ErrParse, file, err)
 	}
 
 	// skiplines the first two lines of a Wasabi file are headers
@@ -236,12 +236,16 @@ func ParseS3(file string) ([]S3LogLine, error) {
 
 	// Log to metrics in JOb
 	// fmt.Printf("Lines to process %d\n", len(lines))
-	for _, line := range lines {
+	for n, line := range lines {
 		if skiplines < 2 {
 			skiplines += 1
 			continue
 		}
 
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
 		match := regex.FindStringSubmatch(line)
 
 		// If the match fails we have a log line we don't
@@ -249,6 +253,7 @@ func ParseS3(file string) ([]S3LogLine, error) {
 		if len(match) == 0 {
 			log.Println("Regex failed: ", S3Regex)
 			log.Println("For: ", line)
+			return nil, fmt.Errorf("%w: %s: line %d doesn't match the S3 log format", ErrParse, file, n+1)
 		}
 
 		lineItem := new(S3LogLine)
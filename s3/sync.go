@@ -101,6 +101,13 @@ type SyncConfiguration struct {
 	// Hook web hook to post events to
 	Hook WebHookConfig `yaml:"hook" json:"hook"`
 
+	// Priority class for this customer's jobs, high, normal, or low
+	Priority string `yaml:"priority" json:"priority"`
+
+	// MaxConcurrentJobs limits this customer's jobs queued to or
+	// running on workers, 0 uses the dispatcher default
+	MaxConcurrentJobs int `yaml:"maxConcurrentJobs" json:"maxConcurrentJobs"`
+
 	// TODO: Move to environment
 	Kubectx string `yaml:"kubectx" json:"kubectx"`
 
@@ -5,11 +5,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"sync"
 	"time"
 )
@@ -17,6 +20,7 @@ import (
 // Type of Schedulers
 const (
 	constantIntervaleScheduler = "Constant interval scheduler"
+	cronScheduler              = "Cron scheduler"
 )
 
 // TODO: create scheduler configuration with environment overrides
@@ -37,19 +41,53 @@ const (
 	currentJobChannelCapacity       = "current_job_channel_capacity"
 	currentResultChannelUtilization = "current_result_channel_utilization"
 	currentResultChannelCapacit     = "current_result_channel_capacity"
-	numberOfJobTimedOut             = "number_of_jobs_sent"
+	numberOfJobTimedOut             = "number_of_jobs_timed_out"
 	averageJobProcessingTime        = "average_job_processing_time"
+	jobProcessingTimeP50            = "job_processing_time_p50"
+	jobProcessingTimeP95            = "job_processing_time_p95"
+	jobProcessingTimeP99            = "job_processing_time_p99"
+	resultsSucceeded                = "results_succeeded"
+	resultsFailed                   = "results_failed"
+	skippedRuns                     = "skipped_runs"
+	replacedRuns                    = "replaced_runs"
+	adhocRuns                       = "adhoc_runs"
 )
 
 type eventScheduler struct {
-	jobList               []*logQueueJob
+	jobList               []Job
 	schedulerJobChan      chan Job       // Channel to read jobs from
 	schedulerResponseChan chan Result    // Channel to write repose to
 	schedulerDone         chan bool      // Shutdown initiated by application
 	schedulerInterrupt    chan os.Signal // Shutdown initiated by OS
+	channelsChanged       chan bool      // Wakes the result reader
+	pauseChanged          chan bool      // Wakes a paused scheduler
+	scheduleChanged       chan bool      // Wakes a waiting scheduler
+	stopScheduling        chan bool      // Closed by Shutdown
+	flushResults          chan bool      // Closed by FlushResults
+	resultsFlushed        chan bool      // Closed when the result reader exits
+	shutdownOnce          *sync.Once
+	flushOnce             *sync.Once
+	readerOnce            *sync.Once
 	metrics               SchedulerMetrics
 	mux                   *sync.Mutex
 	schedule              eventSchedule
+	cron                  *cronSchedule // Parsed schedule.CronExpression
+	timers                map[string]*jobTimer
+	timerHeap             jobHeap // Enabled jobs by next run time
+	jobTimes              []int   // Last ResponseTimeJobs run times in ms
+	history               jobHistory
+	status                SchedulerStatus
+
+	// Runs by run ID until they finish
+	runs map[string]*scheduledRun
+}
+
+// scheduleResponse is the schedule and the current state
+// of the scheduler
+type scheduleResponse struct {
+	eventSchedule
+	NextRunTime time.Time       `json:"next_run_time"`
+	Status      SchedulerStatus `json:"status"`
 }
 
 // eventSchedule holds the type of scheduler and it's configuration
@@ -58,17 +96,63 @@ type eventSchedule struct {
 	ScheduleType        string `json:"schedule_type"`
 	SendIntervalSeconds int64  `json:"send_interval_seconds"`
 	ResponseTimeJobs    int    `json:"response_time_jobs"`
+
+	// For the cron scheduler, for example "5 * * * *" or
+	// "0 2 * * mon-fri", TimeZone defaults to UTC
+	CronExpression string `json:"cron_expression,omitempty"`
+	TimeZone       string `json:"time_zone,omitempty"`
+}
+
+// validate checks the schedule returning the parsed cron
+// expression for the cron scheduler
+func (es *eventSchedule) validate() (*cronSchedule, error) {
+	if es.ResponseTimeJobs < 1 {
+		return nil, errors.New("response_time_jobs must be at least 1")
+	}
+
+	switch es.ScheduleType {
+	case constantIntervaleScheduler:
+		if es.SendIntervalSeconds < 1 {
+			return nil, errors.New("send_interval_seconds must be at least 1")
+		}
+		return nil, nil
+
+	case cronScheduler:
+		loc, err := time.LoadLocation(es.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("bad time_zone: %v", err)
+		}
+		return parseCron(es.CronExpression, loc)
+	}
+
+	return nil, fmt.Errorf("schedule_type must be %q or %q",
+		constantIntervaleScheduler, cronScheduler)
 }
 
 // SchedulerMetrics hold metrics about the Scheduler, Jobs, and Results
 // We export attributes we want included in the JSON output
 type SchedulerMetrics struct {
-	StartTime time.Time      `json:"start_time"`
-	UpTime    time.Duration  `json:"up_time"`
-	Counters  map[string]int `json:"counters"`
+	StartTime time.Time                  `json:"start_time"`
+	UpTime    time.Duration              `json:"up_time"`
+	Counters  map[string]int             `json:"counters"`
+	JobTypes  map[string]*jobTypeMetrics `json:"job_types"`
 	mux       *sync.Mutex
 }
 
+// jobTypeMetrics counts results for one type of job
+type jobTypeMetrics struct {
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+	TimedOut  int `json:"timed_out"`
+}
+
+// jobRunStats are the Stats fields job types have in common,
+// read from Job.Metrics()
+type jobRunStats struct {
+	RequestTimedOut bool
+	RequestTime     time.Duration
+}
+
 func (s *eventScheduler) MetricToJSON() ([]byte, error) {
 	s.metrics.mux.Lock()
 	defer s.metrics.mux.Unlock()
@@ -105,6 +189,31 @@ func (s *eventScheduler) MetricSet(key string, value int) {
 	s.metrics.mux.Unlock()
 }
 
+// MetricJobResult counts a result for jobType
+func (s *eventScheduler) MetricJobResult(jobType string, failed, timedOut bool) {
+	s.metrics.mux.Lock()
+	defer s.metrics.mux.Unlock()
+
+	jm, ok := s.metrics.JobTypes[jobType]
+	if !ok {
+		jm = &jobTypeMetrics{}
+		s.metrics.JobTypes[jobType] = jm
+	}
+
+	if failed {
+		jm.Failed++
+		s.metrics.Counters[resultsFailed]++
+	} else {
+		jm.Succeeded++
+		s.metrics.Counters[resultsSucceeded]++
+	}
+
+	if timedOut {
+		jm.TimedOut++
+		s.metrics.Counters[numberOfJobTimedOut]++
+	}
+}
+
 func (s *eventScheduler) MetricValue(key string) int {
 	s.metrics.mux.Lock()
 	defer s.metrics.mux.Unlock()
@@ -112,10 +221,39 @@ func (s *eventScheduler) MetricValue(key string) int {
 }
 
 // UpdateJobList to a new list safely
-func (s *eventScheduler) UpdateJobList(newJobList []*logQueueJob) {
+func (s *eventScheduler) UpdateJobList(newJobList []Job) {
 	s.mux.Lock()
 	s.jobList = newJobList
 	s.mux.Unlock()
+	s.timersChanged()
+}
+
+// jobResponse builds the API view of a job
+func (s *eventScheduler) jobResponse(j Job) listJobsResponse {
+	row := listJobsResponse{
+		ID:          j.ID(),
+		Type:        j.Type(),
+		Params:      s.jobParams(j.ID()),
+		jobSchedule: s.jobScheduleFor(j.ID()),
+	}
+	if row.Enabled == nil {
+		enabled := true
+		row.Enabled = &enabled
+	}
+	if next := s.jobNextRun(j.ID()); !next.IsZero() {
+		row.NextRunTime = &next
+	}
+	row.Running, row.SkippedRuns = s.jobRuns(j.ID())
+	return row
+}
+
+// jobs returns a copy of the job list
+func (s *eventScheduler) jobs() []Job {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	jl := make([]Job, len(s.jobList))
+	copy(jl, s.jobList)
+	return jl
 }
 
 // Required object methods for interface
@@ -124,12 +262,8 @@ func (s *eventScheduler) UpdateJobList(newJobList []*logQueueJob) {
 func (s *eventScheduler) GetScheduledJobs() ([]byte, error) {
 	var response []listJobsResponse
 
-	for _, v := range interface{}(s.jobList).([]*logQueueJob) {
-		var newRow = listJobsResponse{}
-		newRow.ID = v.JobID.String()
-		//		newRow.URL = v.JobURL.String()
-		newRow.Type = v.JobType
-		response = append(response, newRow)
+	for _, v := range s.jobs() {
+		response = append(response, s.jobResponse(v))
 	}
 
 	jb, e := json.Marshal(response)
@@ -140,14 +274,14 @@ func (s *eventScheduler) GetScheduledJobs() ([]byte, error) {
 }
 
 // GetScheduleJob returns a single job matching the UUID provided
+// with its recent executions
 func (s *eventScheduler) GetScheduleJob(UUID string) (httpStatusCode int, jsonBlob []byte, err error) {
-	var newRow = listJobsResponse{}
+	var newRow = jobDetailResponse{}
 
-	for _, v := range interface{}(s.jobList).([]*logQueueJob) {
+	for _, v := range s.jobs() {
 		if v.ID() == UUID {
-			newRow.ID = v.ID()
-			//			newRow.URL = v.JobURL.String()
-			newRow.Type = v.JobType
+			newRow.listJobsResponse = s.jobResponse(v)
+			newRow.History = s.history.Get(v.ID())
 			break
 		}
 	}
@@ -172,7 +306,7 @@ func (s *eventScheduler) GetScheduleJob(UUID string) (httpStatusCode int, jsonBl
 func (s *eventScheduler) UpdateScheduleJob(jsonBlob []byte) (httpStatusCode int, jsonb []byte, err error) {
 	var updateData = listJobsResponse{}
 	var oldJobID, newJobID string
-	var newJobList []*logQueueJob
+	var newJobList []Job
 	foundJob := false
 
 	e := json.Unmarshal(jsonBlob, &updateData)
@@ -183,9 +317,25 @@ func (s *eventScheduler) UpdateScheduleJob(jsonBlob []byte) (httpStatusCode int,
 		return http.StatusBadRequest, []byte(msg), e
 	}
 
-	for _, v := range interface{}(s.jobList).([]*logQueueJob) {
+	for _, v := range s.jobs() {
 		if v.ID() == updateData.ID {
-			newJob := logQueueJob{}
+			// The new job keeps the old schedule unless changed
+			js := s.jobScheduleFor(v.ID()).merge(updateData.jobSchedule)
+			cs, e := js.validate()
+			if e != nil {
+				msg := fmt.Sprintf("{\"error\": \"invalid schedule\", \"Error\": \"%v\"}", e.Error())
+				return http.StatusBadRequest, []byte(msg), e
+			}
+
+			// The type and params are kept unless changed
+			jobType, params := v.Type(), s.jobParams(v.ID())
+			if updateData.Type != "" && updateData.Type != jobType {
+				jobType, params = updateData.Type, nil
+			}
+			if updateData.Params != nil {
+				params = updateData.Params
+			}
+
 			/*
 				pu, err := url.Parse(updateData.URL)
 				if err != nil {
@@ -195,13 +345,17 @@ func (s *eventScheduler) UpdateScheduleJob(jsonBlob []byte) (httpStatusCode int,
 				}
 			*/
 			//			newJob.JobURL = pu
-			e = newJob.Init()
+			newJob, status, e := s.buildJob(jobType, params)
 			if e != nil {
-				msg := fmt.Sprintf("{\"error\": \"job init failed\", \"Error\": \"%v\"}", e.Error())
-				return http.StatusInternalServerError, []byte(msg), e
+				msg := fmt.Sprintf("{\"error\": \"job create failed\", \"Error\": \"%v\"}", e.Error())
+				return status, []byte(msg), e
 			}
 
-			newJobList = append(newJobList, &newJob)
+			s.mux.Lock()
+			s.setJobSchedule(newJob, js, cs, params)
+			s.mux.Unlock()
+
+			newJobList = append(newJobList, newJob)
 			oldJobID = v.ID()
 			newJobID = newJob.ID()
 			foundJob = true
@@ -218,6 +372,7 @@ func (s *eventScheduler) UpdateScheduleJob(jsonBlob []byte) (httpStatusCode int,
 
 	// Update job list and return
 	s.UpdateJobList(newJobList)
+	s.history.Forget(oldJobID)
 
 	msg := fmt.Sprintf("{\"success\": \"Old job %v replaced by new job %v\"}",
 		oldJobID, newJobID)
@@ -237,7 +392,15 @@ func (s *eventScheduler) CreateScheduleJob(jsonBlob []byte) (httpStatusCode int,
 		return http.StatusBadRequest, []byte(msg), e
 	}
 
-	newJob := logQueueJob{}
+	cs, e := newJobType.jobSchedule.validate()
+	if e != nil {
+		msg := fmt.Sprintf("{\"error\": \"invalid schedule\", \"Error\": \"%v\"}", e.Error())
+		return http.StatusBadRequest, []byte(msg), e
+	}
+
+	if newJobType.Type == "" {
+		newJobType.Type = LogQueueJobType
+	}
 	/*
 		pu, err := url.Parse(newJobType.URL)
 		if err != nil {
@@ -246,25 +409,47 @@ func (s *eventScheduler) CreateScheduleJob(jsonBlob []byte) (httpStatusCode int,
 		}
 	*/
 	//	newJob.JobURL = pu
-	e = newJob.Init()
+	newJob, status, e := s.buildJob(newJobType.Type, newJobType.Params)
+	if e != nil {
+		msg := fmt.Sprintf("{\"error\": \"job create failed\", \"Error\": \"%v\"}", e.Error())
+		return status, []byte(msg), e
+	}
+
+	s.mux.Lock()
+	s.jobList = append(s.jobList, newJob)
+	s.setJobSchedule(newJob, newJobType.jobSchedule, cs, newJobType.Params)
+	s.mux.Unlock()
+	s.timersChanged()
+
+	jb, e := json.Marshal(s.jobResponse(newJob))
 	if e != nil {
-		msg := fmt.Sprintf("{\"error\": \"job init failed\", \"Error\": \"%v\"}", e.Error())
+		msg := fmt.Sprintf("{\"error\": \"json.Marshal failed\", \"Error\": \"%v\"}", e.Error())
 		return http.StatusInternalServerError, []byte(msg), e
 	}
+	return http.StatusCreated, jb, nil
+}
 
-	s.jobList = append(s.jobList, &newJob)
+// buildJob returns a new job of jobType with params applied and the
+// HTTP status to return if that fails
+func (s *eventScheduler) buildJob(jobType string, params json.RawMessage) (Job, int, error) {
+	j, e := newJobFromSpec(jobType, params)
+	if e != nil {
+		return nil, http.StatusBadRequest, e
+	}
 
-	msg := fmt.Sprintf("{\"success\": \"new job %v added\"}", newJob.ID())
-	return http.StatusCreated, []byte(msg), nil
+	if e = j.InitWithJobChan(s.jobChan()); e != nil {
+		return nil, http.StatusInternalServerError, e
+	}
+	return j, http.StatusCreated, nil
 }
 
 // DeleteScheduleJob delete the job with ID == uuid
 // Returns httpStatusCode, JSON body, and error code
 func (s *eventScheduler) DeleteScheduleJob(uuid string) (httpStatusCode int, jsonb []byte, err error) {
-	var newJobList []*logQueueJob
+	var newJobList []Job
 	var foundJob = false
 
-	for _, v := range interface{}(s.jobList).([]*logQueueJob) {
+	for _, v := range s.jobs() {
 		if v.ID() == uuid {
 			foundJob = true
 			continue
@@ -280,6 +465,7 @@ func (s *eventScheduler) DeleteScheduleJob(uuid string) (httpStatusCode int, jso
 
 	// Update job list and return
 	s.UpdateJobList(newJobList)
+	s.history.Forget(uuid)
 
 	msg := fmt.Sprintf("{\"success\": \"Job %v deleted\"}", uuid)
 	return http.StatusOK, []byte(msg), nil
@@ -288,7 +474,16 @@ func (s *eventScheduler) DeleteScheduleJob(uuid string) (httpStatusCode int, jso
 // Object methods for schedules
 func (s *eventScheduler) GetSchedule() (httpStatusCode int, jsonBlob []byte, err error) {
 
-	jb, e := json.Marshal(s.schedule)
+	next := s.nextRunTime()
+
+	s.mux.Lock()
+	response := scheduleResponse{
+		eventSchedule: s.schedule,
+		NextRunTime:   next,
+		Status:        s.status}
+	s.mux.Unlock()
+
+	jb, e := json.Marshal(response)
 	if e != nil {
 		msg := fmt.Sprintf("{\"json.Marsha failed\": \"%v\"}", e)
 		return http.StatusInternalServerError, []byte(msg), e
@@ -306,14 +501,28 @@ func (s *eventScheduler) UpdateSchedule(jsonBlob []byte) (httpStatusCode int, js
 		return http.StatusInternalServerError, []byte(msg), e
 	}
 
+	// Only fields provided are changed
 	s.mux.Lock()
-	s.schedule.SendIntervalSeconds = us.SendIntervalSeconds
+	ns := s.schedule
 	s.mux.Unlock()
 
-	msg := fmt.Sprintf("{\"Status\": \"Success\", \"New interval seconds\": %v}",
-		s.schedule.SendIntervalSeconds)
+	if us.ScheduleType != "" {
+		ns.ScheduleType = us.ScheduleType
+	}
+	if us.SendIntervalSeconds != 0 {
+		ns.SendIntervalSeconds = us.SendIntervalSeconds
+	}
+	if us.CronExpression != "" {
+		ns.CronExpression = us.CronExpression
+	}
+	if us.TimeZone != "" {
+		ns.TimeZone = us.TimeZone
+	}
+	if us.ResponseTimeJobs != 0 {
+		ns.ResponseTimeJobs = us.ResponseTimeJobs
+	}
 
-	return http.StatusOK, []byte(msg), nil
+	return s.setSchedule(ns, http.StatusOK)
 }
 
 // CreateSchedule replace current schdule objec
@@ -327,91 +536,295 @@ func (s *eventScheduler) CreateSchedule(jsonBlob []byte) (httpStatusCode int, js
 	}
 
 	s.mux.Lock()
-	s.schedule.ScheduleType = us.ScheduleType
-	s.schedule.SendIntervalSeconds = us.SendIntervalSeconds
+	ns := s.schedule
+	s.mux.Unlock()
+
+	ns.ScheduleType = us.ScheduleType
+	if ns.ScheduleType == "" {
+		ns.ScheduleType = constantIntervaleScheduler
+	}
+	ns.SendIntervalSeconds = us.SendIntervalSeconds
+	ns.CronExpression = us.CronExpression
+	ns.TimeZone = us.TimeZone
+	if us.ResponseTimeJobs != 0 {
+		ns.ResponseTimeJobs = us.ResponseTimeJobs
+	}
+
+	return s.setSchedule(ns, http.StatusCreated)
+}
+
+// setSchedule validates and replaces the current schedule, a waiting
+// scheduler recomputes when it next runs
+func (s *eventScheduler) setSchedule(ns eventSchedule, okStatus int) (httpStatusCode int, jsonb []byte, err error) {
+	cs, e := ns.validate()
+	if e != nil {
+		msg := fmt.Sprintf("{\"error\": \"invalid schedule\", \"Error\": \"%v\"}", e)
+		return http.StatusBadRequest, []byte(msg), e
+	}
+
+	s.mux.Lock()
+	s.schedule = ns
+	s.cron = cs
 	s.mux.Unlock()
+	s.timersChanged()
+
+	if cs != nil {
+		msg := fmt.Sprintf("{\"Status\": \"Success\", \"Next run time\": \"%v\"}",
+			s.nextRunTime().Format(time.RFC3339))
+		return okStatus, []byte(msg), nil
+	}
 
 	msg := fmt.Sprintf("{\"Status\": \"Success\", \"New interval seconds\": %v}",
-		s.schedule.SendIntervalSeconds)
-	return http.StatusCreated, []byte(msg), nil
+		ns.SendIntervalSeconds)
+	return okStatus, []byte(msg), nil
 }
 
 func (s *eventScheduler) DeleteSchedule() (httpStatusCode int, jsonb []byte, err error) {
 
-	s.schedulerDone <- true
+	select {
+	case s.schedulerDone <- true:
+	default:
+	}
 	msg := fmt.Sprintf("{\"Status\": \"Success scheduler stopped\"}")
 	return http.StatusOK, []byte(msg), nil
 }
 
 // SetChannels initializes channels the dispatcher has created inside
-// of the scheduler
+// of the scheduler.  The dispatcher calls it again when it resizes
+// the job or result channels, so it may run before Init.
 func (s *eventScheduler) SetChannels(j chan Job, r chan Result, b chan bool, i chan os.Signal) {
+	if s.mux == nil {
+		s.mux = new(sync.Mutex)
+		s.channelsChanged = make(chan bool, 1)
+	}
+
+	s.mux.Lock()
 	s.schedulerJobChan = j
 	s.schedulerResponseChan = r
-	s.schedulerDone = b
-	s.schedulerInterrupt = i
+
+	// Only the job and result channels are resized, the loops
+	// read these two without holding the lock
+	if s.schedulerDone != b {
+		s.schedulerDone = b
+	}
+	if s.schedulerInterrupt != i {
+		s.schedulerInterrupt = i
+	}
+
+	// Jobs that produce jobs hold their own copy
+	for _, sj := range s.jobList {
+		if qj, ok := sj.(*logQueueJob); ok {
+			qj.setJobChan(j)
+		}
+	}
+	s.mux.Unlock()
+
+	select {
+	case s.channelsChanged <- true:
+	default:
+	}
 
 	return
 }
 
+// jobChan returns the current job channel
+func (s *eventScheduler) jobChan() chan Job {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.schedulerJobChan
+}
+
+// resultChan returns the current result channel
+func (s *eventScheduler) resultChan() chan Result {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.schedulerResponseChan
+}
+
 // Init load defaults jobs and initialize
 func (s *eventScheduler) Init() error {
 	s.metrics.Counters = make(map[string]int)
+	s.metrics.JobTypes = make(map[string]*jobTypeMetrics)
 
-	s.mux = new(sync.Mutex)
+	if s.mux == nil {
+		s.mux = new(sync.Mutex)
+		s.channelsChanged = make(chan bool, 1)
+	}
 	s.metrics.mux = new(sync.Mutex)
 	s.schedule.ResponseTimeJobs = defaultResponseTimeJobs
 
+	s.pauseChanged = make(chan bool, 1)
+	s.scheduleChanged = make(chan bool, 1)
+	s.timers = make(map[string]*jobTimer)
+	s.runs = make(map[string]*scheduledRun)
+	s.stopScheduling = make(chan bool)
+	s.flushResults = make(chan bool)
+	s.resultsFlushed = make(chan bool)
+	s.shutdownOnce = new(sync.Once)
+	s.flushOnce = new(sync.Once)
+	s.readerOnce = new(sync.Once)
+
+	var hs historyStore
+	if dir := os.Getenv("EB_JOB_HISTORY_DIR"); dir != "" {
+		hs = newDiskHistoryStore(dir)
+	}
+	s.history.Init(JobHistorySize, hs)
+
 	s.schedule.SendIntervalSeconds = defaultConstantInterval
 	s.schedule.ScheduleType = constantIntervaleScheduler
 
 	// Setup logQueueJob
-	nj := logQueueJob{}
-	nj.InitWithJobChan(s.schedulerJobChan)
-	s.jobList = append(s.jobList, &nj)
+	nj := &logQueueJob{}
+	nj.InitWithJobChan(s.jobChan())
+	s.mux.Lock()
+	s.jobList = append(s.jobList, nj)
+	s.mux.Unlock()
+	s.timersChanged()
 
 	return nil
 }
 
 func (s *eventScheduler) Run() error {
-	go s.RunScheduler()
-	go s.RunResultsReader()
+	s.startScheduler()
+	s.startResultsReader()
 
 	return nil
 }
 
+// startScheduler runs RunScheduler unless it is already running
+func (s *eventScheduler) startScheduler() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.status.SchedulerRunning {
+		return
+	}
+	s.status.SchedulerRunning = true
+
+	go func() {
+		s.RunScheduler()
+		s.mux.Lock()
+		s.status.SchedulerRunning = false
+		s.mux.Unlock()
+		log.Println("Scheduler stopped")
+	}()
+}
+
+// startResultsReader runs RunResultsReader unless it is already running
+func (s *eventScheduler) startResultsReader() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.status.ResultCollectorRunning {
+		return
+	}
+	s.status.ResultCollectorRunning = true
+
+	go func() {
+		s.RunResultsReader()
+		s.mux.Lock()
+		s.status.ResultCollectorRunning = false
+		s.mux.Unlock()
+		log.Println("Result reader stopped")
+	}()
+}
+
 func (s *eventScheduler) RunScheduler() error {
 	s.MetricSetStartTime()
 	for {
+		if !s.waitWhilePaused() {
+			return nil
+		}
+
+		// A nil channel never fires, no run is due
+		var due <-chan time.Time
+		if next := s.nextRunTime(); !next.IsZero() {
+			due = time.After(time.Until(next))
+		}
+
+		select {
+		case <-s.schedulerDone:
+			return nil
+		case <-s.schedulerInterrupt:
+			return nil
+		case <-s.stopScheduling:
+			return nil
+		case <-s.scheduleChanged:
+			continue
+		case <-s.pauseChanged:
+			continue
+		case <-due:
+		}
+
+		// Each job runs on its own schedule
 		s.MetricInc(schedulerIterations)
-		for _, j := range s.jobList {
-			s.schedulerJobChan <- j
+		for _, j := range s.dueJobs(time.Now()) {
+			run := s.newRun(j)
+			if run == nil {
+				continue
+			}
+
+			jc := s.jobChan()
+			select {
+			case jc <- run:
+			case <-s.schedulerDone:
+				s.runFinished(run)
+				return nil
+			case <-s.schedulerInterrupt:
+				s.runFinished(run)
+				return nil
+			case <-s.stopScheduling:
+				s.runFinished(run)
+				return nil
+			}
 			s.MetricInc(jobsSent)
-			s.MetricSet(currentJobChannelCapacity, cap(s.schedulerJobChan))
-			s.MetricSet(currentJobChannelUtilization, len(s.schedulerJobChan))
-			s.MetricSet(jobListSize, len(s.jobList))
+			s.MetricSet(currentJobChannelCapacity, cap(jc))
+			s.MetricSet(currentJobChannelUtilization, len(jc))
+			s.MetricSet(jobListSize, len(s.jobs()))
 		}
 		s.MetricUpdateUpTime()
+	}
+}
+
+// nextRunTime returns when the next job is due, the zero time
+// if no jobs are enabled
+func (s *eventScheduler) nextRunTime() time.Time {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if len(s.timerHeap) == 0 {
+		return time.Time{}
+	}
+	return s.timerHeap[0].next
+}
+
+// waitWhilePaused blocks until the scheduler is resumed.  It returns
+// false if the scheduler is stopped while waiting.
+func (s *eventScheduler) waitWhilePaused() bool {
+	for s.Status().SchedulerPaused {
 		select {
+		case <-s.pauseChanged:
 		case <-s.schedulerDone:
-			return nil
+			return false
 		case <-s.schedulerInterrupt:
-			return nil
-		default:
-			time.Sleep(time.Duration(s.schedule.SendIntervalSeconds) * time.Second)
+			return false
+		case <-s.stopScheduling:
+			return false
 		}
 	}
+	return true
 }
 
 // ComputeAverageResponseTime Keep track of the last N responses
+// where N is ResponseTimeJobs
 func (s *eventScheduler) ComputeAverageResponseTime(jt []int, newTime int) ([]int, int) {
-	currentLength := len(jt)
-	desiredLength := currentLength - 9
-	if currentLength >= s.schedule.ResponseTimeJobs {
-		jt = jt[desiredLength:currentLength]
-	}
+	s.mux.Lock()
+	window := s.schedule.ResponseTimeJobs
+	s.mux.Unlock()
+
 	jt = append(jt, newTime)
-	currentLength = len(jt)
+	if len(jt) > window {
+		jt = append([]int(nil), jt[len(jt)-window:]...)
+	}
+	currentLength := len(jt)
 
 	var totalTime int = 0
 	for _, t := range jt {
@@ -421,32 +834,46 @@ func (s *eventScheduler) ComputeAverageResponseTime(jt []int, newTime int) ([]in
 	return jt, totalTime / currentLength
 }
 
+// responseTimePercentile returns the nearest rank percentile p of jt
+func responseTimePercentile(jt []int, p int) int {
+	if len(jt) == 0 {
+		return 0
+	}
+
+	sorted := append([]int(nil), jt...)
+	sort.Ints(sorted)
+
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// RunResultsReader reads results until FlushResults is called or
+// an interrupt is received.  It does not read the done channel so
+// stopping the scheduler doesn't lose results for jobs in flight.
 func (s *eventScheduler) RunResultsReader() error {
-	//jobTimes := make([]int, 0, s.schedule.ResponseTimeJobs)
 	log.Println("Starting result reader")
+	defer s.readerOnce.Do(func() { close(s.resultsFlushed) })
+
 	for {
 		select {
-		case currentResult := <-s.schedulerResponseChan:
-			s.MetricInc(resultsReceived)
-			s.MetricSet(currentResultChannelCapacit, cap(s.schedulerJobChan))
-			s.MetricSet(currentResultChannelUtilization, len(s.schedulerJobChan))
-			jobFromResult, err := currentResult.Decode()
-			if err != nil {
-				log.Printf("Processing response for job ID %v\n", jobFromResult.ID())
-			}
-			/*
-				j := currentResult.Job()
-				if j.(*logQueueJob).Stats.RequestTimedOut {
-					s.MetricInc(numberOfJobTimedOut)
+		case currentResult := <-s.resultChan():
+			s.processResult(currentResult)
+
+		case <-s.channelsChanged:
+			// Loop to pick up the new result channel
+
+		case <-s.flushResults:
+			// Read what the dispatcher has already queued
+			for {
+				select {
+				case currentResult := <-s.resultChan():
+					s.processResult(currentResult)
+				default:
+					return nil
 				}
-				jt, avg := s.ComputeAverageResponseTime(jobTimes, int(j.(*logQueueJob).Stats.RequestTime))
-				s.MetricSet(averageJobProcessingTime, avg)
-				jobTimes = jt
-			*/
-
-		case done := <-s.schedulerDone:
-			if done {
-				return nil
 			}
 
 		case <-s.schedulerInterrupt:
@@ -455,16 +882,160 @@ func (s *eventScheduler) RunResultsReader() error {
 	}
 }
 
-func (s *eventScheduler) Pause() []byte {
+// processResult updates metrics for a single result
+// A result fails if it can't be decoded, the job reports errors,
+// or it was built by LogErrorResults
+func (s *eventScheduler) processResult(currentResult Result) {
+	rc := s.resultChan()
+	s.MetricInc(resultsReceived)
+	s.MetricSet(currentResultChannelCapacit, cap(rc))
+	s.MetricSet(currentResultChannelUtilization, len(rc))
+
+	jobType := "unknown"
+	failed := false
+	stats := jobRunStats{}
+
+	jobFromResult, err := currentResult.Decode()
+	if err != nil {
+		log.Printf("Decoding result failed: %v\n", err)
+		failed = true
+	} else {
+		jobType = jobFromResult.Type()
+		if e := json.Unmarshal(jobFromResult.Metrics(), &stats); e != nil {
+			log.Printf("Reading stats for job ID %v failed: %v\n", jobFromResult.ID(), e)
+		}
+	}
+
+	if _, ok := currentResult.MetaData()["original_error"]; ok {
+		failed = true
+	}
 
+	// Errors a rerun won't fix need someone to look at them
+	errs := resultErrors(currentResult)
+	for _, e := range errs {
+		if !e.Retryable {
+			log.Printf("Job type %v failed permanently: %v: %v\n", jobType, e.Code, e.Message)
+		}
+	}
+
+	switch {
+	case len(errs) == 0:
+	case partialResult(currentResult):
+		s.MetricInc(resultsPartial)
+	case retryable(errs):
+		failed = true
+		s.MetricInc(resultsRetryable)
+	default:
+		failed = true
+		s.MetricInc(resultsPermanent)
+	}
+
+	s.MetricJobResult(jobType, failed, stats.RequestTimedOut)
+
+	if stats.RequestTime > 0 {
+		jt, avg := s.ComputeAverageResponseTime(s.jobTimes, int(stats.RequestTime.Milliseconds()))
+		s.jobTimes = jt
+		s.MetricSet(averageJobProcessingTime, avg)
+		s.MetricSet(jobProcessingTimeP50, responseTimePercentile(jt, 50))
+		s.MetricSet(jobProcessingTimeP95, responseTimePercentile(jt, 95))
+		s.MetricSet(jobProcessingTimeP99, responseTimePercentile(jt, 99))
+	}
+}
+
+// Pause stops sending jobs after the current iteration, the
+// result reader keeps running
+func (s *eventScheduler) Pause() error {
+	s.mux.Lock()
+	s.status.SchedulerPaused = true
+	s.mux.Unlock()
+	s.wakePaused()
 	return nil
 }
 
-func (s *eventScheduler) Shutdown() error {
+// Resume starts sending jobs again after Pause
+func (s *eventScheduler) Resume() error {
+	s.mux.Lock()
+	running := s.status.SchedulerRunning
+	s.status.SchedulerPaused = false
+	s.mux.Unlock()
 
+	if !running {
+		return errors.New("scheduler is not running")
+	}
+	s.wakePaused()
 	return nil
 }
 
+// Restart starts the scheduler and result reader if either has
+// exited, for example after DeleteSchedule, and resumes sending jobs
+func (s *eventScheduler) Restart() error {
+	if s.shuttingDown() {
+		return errors.New("scheduler is shutting down")
+	}
+
+	// Discard a stop request left over from an exited scheduler
+	select {
+	case <-s.schedulerDone:
+	default:
+	}
+
+	s.mux.Lock()
+	s.status.SchedulerPaused = false
+	s.mux.Unlock()
+	s.wakePaused()
+
+	s.startScheduler()
+	s.startResultsReader()
+	return nil
+}
+
+// Status returns a copy of the scheduler status
+func (s *eventScheduler) Status() SchedulerStatus {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.status
+}
+
+// wakePaused tells a waiting scheduler the pause state changed
+func (s *eventScheduler) wakePaused() {
+	select {
+	case s.pauseChanged <- true:
+	default:
+	}
+}
+
+// shuttingDown is true once Shutdown or FlushResults has been called
+func (s *eventScheduler) shuttingDown() bool {
+	select {
+	case <-s.stopScheduling:
+		return true
+	case <-s.flushResults:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown stops sending new jobs, the result reader keeps
+// running until FlushResults is called
+func (s *eventScheduler) Shutdown() error {
+	s.shutdownOnce.Do(func() { close(s.stopScheduling) })
+	return nil
+}
+
+// FlushResults reads any queued results and stops the result reader
+// It returns when the reader has exited or ctx is done
+func (s *eventScheduler) FlushResults(ctx context.Context) error {
+	s.flushOnce.Do(func() { close(s.flushResults) })
+
+	select {
+	case <-s.resultsFlushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // Status methods
 // DeleteSchedule stops go scheduler goroutine
 func (s *eventScheduler) Metrics() []byte {
@@ -4,7 +4,10 @@
 //
 package main
 
-import "os"
+import (
+	"context"
+	"os"
+)
 
 // Scheduler defines the interfaces a scheduler must implement
 type Scheduler interface {
@@ -21,24 +24,34 @@ type Scheduler interface {
 	UpdateScheduleJob(jsonBlob []byte) (httpStatusCode int, jsonb []byte, err error)
 	CreateScheduleJob(jsonBlob []byte) (httpStatusCode int, jsonb []byte, err error)
 	DeleteScheduleJob(UUID string) (httpStatusCode int, jsonb []byte, err error)
+	// RunScheduleJob sends a job now, GetScheduleJobRun polls the run
+	RunScheduleJob(UUID string, jsonBlob []byte) (httpStatusCode int, jsonb []byte, err error)
+	GetScheduleJobRun(UUID, runID string) (httpStatusCode int, jsonBlob []byte, err error)
 
 	// Execution methods
 	Init() error
 	SetChannels(chan Job, chan Result, chan bool, chan os.Signal)
+	// Shutdown stops sending jobs, results are still read
 	Shutdown() error
+	// FlushResults reads queued results then stops reading
+	FlushResults(ctx context.Context) error
 	Run() error
-	//RestartScheduler() error
-	//RestartResultsCollector() error
+	// Pause stops sending jobs until Resume is called
+	Pause() error
+	// Resume sends jobs again after Pause
+	Resume() error
+	// Restart starts the scheduler and result collector if either
+	// has exited and resumes sending jobs
+	Restart() error
 
 	// Status methods
 	Metrics() []byte
-	//Status()
-	//RestartScheduler() error
-	//RestartResultsCollector() error
+	Status() SchedulerStatus
 }
 
 // SchedulerStatus tracks if the scheduler and Results collectors are running
 type SchedulerStatus struct {
-	SchedulerRunning       bool
-	ResultCollectorRunning bool
+	SchedulerRunning       bool `json:"scheduler_running"`
+	SchedulerPaused        bool `json:"scheduler_paused"`
+	ResultCollectorRunning bool `json:"result_collector_running"`
 }
@@ -0,0 +1,105 @@
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root
+// for full license information.
+//
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// workerRestartDelay before a worker that panicked is restarted
+const workerRestartDelay = time.Second
+
+// Metrics constants
+const (
+	dispatcherJobPanics      = "job_panics"
+	dispatcherWorkerPanics   = "worker_panics"
+	dispatcherWorkerRestarts = "worker_restarts"
+)
+
+// Result metadata set when a job panics
+const (
+	metaDataPanic      = "panic"
+	metaDataPanicStack = "panic_stack"
+)
+
+var errJobPanicked = errors.New("job panicked")
+
+// runJob runs j turning a panic into an error result with the
+// stack in its metadata, the job is then retried like any failure
+func (w *worker) runJob(ctx context.Context, j Job) (r Result, err error) {
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+
+		stack := debug.Stack()
+		w.d.MetricInc(dispatcherJobPanics)
+		log.Printf("Job: %v panicked: %v\n%s", j.ID(), p, stack)
+
+		err = fmt.Errorf("%w: %v", errJobPanicked, p)
+		r, _ = (&logResult{}).LogErrorResults(j, err)
+		r.AddMetaData(metaDataPanic, fmt.Sprint(p))
+		r.AddMetaData(metaDataPanicStack, string(stack))
+	}()
+
+	return j.Run(ctx)
+}
+
+// supervise runs w until it retires, restarting it if it panics
+// outside of a job so the pool doesn't shrink
+func (d *dispatcher) supervise(w *worker) {
+	defer w.exit()
+
+	for w.runRecovered() {
+		select {
+		case <-w.done:
+			return
+		case <-time.After(workerRestartDelay):
+		}
+
+		d.MetricInc(dispatcherWorkerRestarts)
+		log.Printf("Worker %d restarted\n", w.id)
+	}
+}
+
+// runRecovered runs w returning true if it panicked
+func (w *worker) runRecovered() (panicked bool) {
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+
+		panicked = true
+		w.d.MetricInc(dispatcherWorkerPanics)
+		log.Printf("Worker %d panicked: %v\n%s", w.id, p, debug.Stack())
+
+		// The job it was running is lost
+		if w.currentJob != nil {
+			log.Printf("Job: %v abandoned by worker %d\n", w.currentJob.ID(), w.id)
+			w.releaseSlot()
+			w.currentJob = nil
+			w.d.jobFinished()
+		}
+	}()
+
+	w.Run()
+	return false
+}
+
+// releaseSlot gives back the tenant slot held by the current job,
+// only the first call for a job releases it
+func (w *worker) releaseSlot() {
+	if w.holdsSlot {
+		w.holdsSlot = false
+		w.d.queues.Done(w.currentJob)
+	}
+}
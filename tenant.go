@@ -0,0 +1,98 @@
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root
+// for full license information.
+//
+package main
+
+// TenantMaxInFlight jobs a tenant without its own limit may have
+// queued to or running on workers, 0 is unlimited
+const TenantMaxInFlight int = 0
+
+// Management API
+const tenantMaxInFlight string = "tenant_max_in_flight"
+
+// tenantJob is implemented by jobs run on behalf of a tenant
+// TenantLimit of 0 uses tenant_max_in_flight
+type tenantJob interface {
+	Tenant() string
+	TenantLimit() int
+}
+
+// jobTenant returns the tenant for j and its limit, jobs without
+// a tenant share the "" tenant which is never limited
+func jobTenant(j Job) (tenant string, limit int) {
+	if tj, ok := j.(tenantJob); ok {
+		return tj.Tenant(), tj.TenantLimit()
+	}
+	return "", 0
+}
+
+// tenantQueue holds the jobs in one priority class, a FIFO per
+// tenant served round robin
+type tenantQueue struct {
+	jobs  map[string][]Job
+	order []string // tenants with queued jobs
+	next  int      // index in order served next
+	size  int
+}
+
+func newTenantQueue() *tenantQueue {
+	return &tenantQueue{jobs: make(map[string][]Job)}
+}
+
+// push adds j to the end of tenant's FIFO
+func (tq *tenantQueue) push(tenant string, j Job) {
+	if len(tq.jobs[tenant]) == 0 {
+		tq.order = append(tq.order, tenant)
+	}
+	tq.jobs[tenant] = append(tq.jobs[tenant], j)
+	tq.size++
+}
+
+// eligible returns the index in order of the next tenant that
+// may run a job, or -1
+func (tq *tenantQueue) eligible(mayRun func(tenant string) bool) int {
+	for i := range tq.order {
+		n := (tq.next + i) % len(tq.order)
+		if mayRun(tq.order[n]) {
+			return n
+		}
+	}
+	return -1
+}
+
+// pop removes the first job of the tenant at index n in order
+func (tq *tenantQueue) pop(n int) (Job, string) {
+	tenant := tq.order[n]
+	q := tq.jobs[tenant]
+	j := q[0]
+	q[0] = nil
+	tq.size--
+
+	if len(q) == 1 {
+		delete(tq.jobs, tenant)
+		tq.order = append(tq.order[:n], tq.order[n+1:]...)
+		tq.next = n
+	} else {
+		tq.jobs[tenant] = q[1:]
+		tq.next = n + 1
+	}
+
+	if tq.next >= len(tq.order) {
+		tq.next = 0
+	}
+	return j, tenant
+}
+
+// drain empties the queue returning the jobs removed
+func (tq *tenantQueue) drain() []Job {
+	var jobs []Job
+	for _, t := range tq.order {
+		jobs = append(jobs, tq.jobs[t]...)
+	}
+	tq.jobs = make(map[string][]Job)
+	tq.order = nil
+	tq.next = 0
+	tq.size = 0
+	return jobs
+}
@@ -0,0 +1,548 @@
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root
+// for full license information.
+//
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MaxWorkflowSteps in a single workflow
+const MaxWorkflowSteps int = 50
+
+// WorkflowHistorySize finished workflows kept for the workflows API
+const WorkflowHistorySize int = 100
+
+// Step states, finished steps and workflows use the
+// execution outcomes succeeded, failed and cancelled
+const (
+	stepPending = "pending"
+	stepRunning = "running"
+	stepSkipped = "skipped"
+)
+
+// Metrics constants
+const (
+	dispatcherWorkflowsStarted   = "workflows_started"
+	dispatcherWorkflowsSucceeded = "workflows_succeeded"
+	dispatcherWorkflowsFailed    = "workflows_failed"
+	dispatcherWorkflowsCancelled = "workflows_cancelled"
+)
+
+var (
+	errWorkflowNotFound = errors.New("workflow not found")
+	errInvalidWorkflow  = errors.New("invalid workflow")
+)
+
+// workflowInput is implemented by jobs that use the payloads of the
+// steps that triggered them, SetInput is called once for each
+// before the job is queued
+type workflowInput interface {
+	SetInput(step string, payload []byte)
+}
+
+// workflowStepSpec is a job and the steps that follow it
+type workflowStepSpec struct {
+	// Name unique within the workflow
+	Name string `json:"name"`
+
+	// Type and Params as used to create a job
+	Type   string          `json:"type"`
+	Params json.RawMessage `json:"params,omitempty"`
+
+	// OnSuccess steps run if this one succeeds
+	OnSuccess []string `json:"on_success,omitempty"`
+
+	// OnFailure steps run if this one fails
+	OnFailure []string `json:"on_failure,omitempty"`
+}
+
+// workflowSpec is the body used to create a workflow.  Steps no
+// other step follows start at once, a step with more than one
+// parent runs when all of them finished the way it follows them.
+type workflowSpec struct {
+	Name  string             `json:"name,omitempty"`
+	Steps []workflowStepSpec `json:"steps"`
+}
+
+// workflowStepStatus is the state of one step
+type workflowStepStatus struct {
+	Name   string     `json:"name"`
+	Type   string     `json:"type"`
+	Status string     `json:"status"`
+	JobID  string     `json:"job_id,omitempty"`
+	Start  *time.Time `json:"start,omitempty"`
+	End    *time.Time `json:"end,omitempty"`
+	Error  string     `json:"error,omitempty"`
+}
+
+// workflowResponse is the state of a workflow
+//
+// swagger:response workflowResponse
+type workflowResponse struct {
+	// in: body
+
+	// ID of the workflow
+	ID string `json:"id"`
+
+	// Name given when it was created
+	Name string `json:"name,omitempty"`
+
+	// Status running, succeeded, failed if any step failed, or
+	// cancelled if steps were still running at shutdown
+	Status string `json:"status"`
+
+	// Created time
+	Created time.Time `json:"created"`
+
+	// Finished once no step is pending or running
+	Finished *time.Time `json:"finished,omitempty"`
+
+	// Steps in the order they were given
+	Steps []workflowStepStatus `json:"steps"`
+}
+
+// workflowTrigger is a parent of a step and when it runs the step
+type workflowTrigger struct {
+	parent    *workflowStep
+	onSuccess bool
+	onFailure bool
+}
+
+// workflowStep is a step of a workflow
+type workflowStep struct {
+	wf       *workflowRun
+	spec     workflowStepSpec
+	job      Job
+	triggers []workflowTrigger
+	status   workflowStepStatus
+	payload  []byte // the result's, kept until the workflow finishes
+}
+
+// finished is true once the step won't run again
+func (st *workflowStep) finished() bool {
+	return st.status.Status != stepPending && st.status.Status != stepRunning
+}
+
+// workflowRun is a created workflow
+type workflowRun struct {
+	resp  workflowResponse
+	steps []*workflowStep
+}
+
+// newWorkflowRun checks spec and creates the job for each step
+func newWorkflowRun(spec workflowSpec) (*workflowRun, error) {
+	if len(spec.Steps) == 0 {
+		return nil, fmt.Errorf("%w: no steps", errInvalidWorkflow)
+	}
+	if len(spec.Steps) > MaxWorkflowSteps {
+		return nil, fmt.Errorf("%w: more than %d steps", errInvalidWorkflow, MaxWorkflowSteps)
+	}
+
+	wf := &workflowRun{resp: workflowResponse{
+		ID:      uuid.New().String(),
+		Name:    spec.Name,
+		Status:  stepRunning,
+		Created: time.Now(),
+	}}
+
+	byName := make(map[string]*workflowStep)
+	for _, ss := range spec.Steps {
+		if ss.Name == "" {
+			return nil, fmt.Errorf("%w: every step needs a name", errInvalidWorkflow)
+		}
+		if _, dup := byName[ss.Name]; dup {
+			return nil, fmt.Errorf("%w: step %s given twice", errInvalidWorkflow, ss.Name)
+		}
+
+		j, err := newJobFromSpec(ss.Type, ss.Params)
+		if err != nil {
+			return nil, fmt.Errorf("step %s: %w", ss.Name, err)
+		}
+
+		st := &workflowStep{wf: wf, spec: ss, job: j}
+		st.status = workflowStepStatus{Name: ss.Name, Type: ss.Type, Status: stepPending}
+		byName[ss.Name] = st
+		wf.steps = append(wf.steps, st)
+	}
+
+	for _, st := range wf.steps {
+		if err := st.link(byName); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := wf.checkAcyclic(); err != nil {
+		return nil, err
+	}
+	return wf, nil
+}
+
+// link adds st as a parent of the steps that follow it
+func (st *workflowStep) link(byName map[string]*workflowStep) error {
+	add := func(name string, success bool) error {
+		child, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("%w: step %s follows unknown step %s", errInvalidWorkflow, st.spec.Name, name)
+		}
+		if child == st {
+			return fmt.Errorf("%w: step %s follows itself", errInvalidWorkflow, name)
+		}
+
+		for i := range child.triggers {
+			if child.triggers[i].parent == st {
+				child.triggers[i].onSuccess = child.triggers[i].onSuccess || success
+				child.triggers[i].onFailure = child.triggers[i].onFailure || !success
+				return nil
+			}
+		}
+		child.triggers = append(child.triggers, workflowTrigger{parent: st, onSuccess: success, onFailure: !success})
+		return nil
+	}
+
+	for _, name := range st.spec.OnSuccess {
+		if err := add(name, true); err != nil {
+			return err
+		}
+	}
+	for _, name := range st.spec.OnFailure {
+		if err := add(name, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkAcyclic removes steps with no unremoved parents until none
+// are left, any left over are in a cycle
+func (wf *workflowRun) checkAcyclic() error {
+	parents := make(map[*workflowStep]int)
+	var ready []*workflowStep
+	for _, st := range wf.steps {
+		parents[st] = len(st.triggers)
+		if len(st.triggers) == 0 {
+			ready = append(ready, st)
+		}
+	}
+
+	removed := 0
+	for len(ready) > 0 {
+		st := ready[0]
+		ready = ready[1:]
+		removed++
+
+		for _, child := range wf.steps {
+			for _, t := range child.triggers {
+				if t.parent == st {
+					parents[child]--
+					if parents[child] == 0 {
+						ready = append(ready, child)
+					}
+				}
+			}
+		}
+	}
+
+	if removed != len(wf.steps) {
+		return fmt.Errorf("%w: steps form a cycle", errInvalidWorkflow)
+	}
+	return nil
+}
+
+// workflows runs workflows and keeps their state
+type workflows struct {
+	d     *dispatcher
+	runs  map[string]*workflowRun
+	byJob map[string]*workflowStep // running steps by job ID
+	done  []string                 // finished workflow IDs oldest first
+	mux   *sync.Mutex
+}
+
+// Init sets defaults
+func (wfs *workflows) Init(d *dispatcher) {
+	wfs.d = d
+	wfs.runs = make(map[string]*workflowRun)
+	wfs.byJob = make(map[string]*workflowStep)
+	wfs.mux = &sync.Mutex{}
+}
+
+// start queues the steps no other step follows
+func (wfs *workflows) start(wf *workflowRun) {
+	wfs.mux.Lock()
+	defer wfs.mux.Unlock()
+
+	wfs.runs[wf.resp.ID] = wf
+	wfs.d.MetricInc(dispatcherWorkflowsStarted)
+
+	for _, st := range wf.steps {
+		if len(st.triggers) == 0 {
+			wfs.run(st)
+		}
+	}
+	wfs.checkDone(wf)
+}
+
+// finished is called with the outcome of every job, it starts or
+// skips the steps following a step's job
+func (wfs *workflows) finished(o jobOutcome) {
+	wfs.mux.Lock()
+	defer wfs.mux.Unlock()
+
+	st, ok := wfs.byJob[o.job.ID()]
+	if !ok {
+		return
+	}
+	delete(wfs.byJob, o.job.ID())
+
+	now := time.Now()
+	st.status.End = &now
+	st.status.Status = outcomeSucceeded
+	if o.result != nil {
+		st.payload = o.result.Payload()
+	}
+
+	if o.failed {
+		st.status.Status = outcomeFailed
+		st.status.Error = "job failed"
+		if o.result != nil && o.result.MetaData()["original_error"] != "" {
+			st.status.Error = o.result.MetaData()["original_error"]
+		} else if errs := o.job.Errors(); len(errs) > 0 && errs[0] != nil {
+			st.status.Error = errs[0].Error()
+		}
+	}
+
+	wfs.resolveChildren(st)
+	wfs.checkDone(st.wf)
+}
+
+// cancelRunning marks the steps still running as cancelled, used by
+// shutdown once the workers have stopped
+func (wfs *workflows) cancelRunning() {
+	wfs.mux.Lock()
+	defer wfs.mux.Unlock()
+
+	now := time.Now()
+	for id, st := range wfs.byJob {
+		delete(wfs.byJob, id)
+		st.status.Status = outcomeCancelled
+		st.status.Error = errDispatcherStopped.Error()
+		st.status.End = &now
+		wfs.resolveChildren(st)
+		wfs.checkDone(st.wf)
+	}
+}
+
+// resolveChildren runs or skips the steps waiting on st, the
+// caller holds wfs.mux
+func (wfs *workflows) resolveChildren(st *workflowStep) {
+	for _, child := range st.wf.steps {
+		for _, t := range child.triggers {
+			if t.parent == st {
+				wfs.resolve(child)
+				break
+			}
+		}
+	}
+}
+
+// resolve runs st once all of its parents finished the way it
+// follows them, or skips it if one didn't, the caller holds wfs.mux
+func (wfs *workflows) resolve(st *workflowStep) {
+	if st.status.Status != stepPending {
+		return
+	}
+
+	skip := false
+	for _, t := range st.triggers {
+		switch t.parent.status.Status {
+		case stepPending, stepRunning:
+			return
+		case outcomeSucceeded:
+			skip = skip || !t.onSuccess
+		case outcomeFailed:
+			skip = skip || !t.onFailure
+		default:
+			skip = true
+		}
+	}
+
+	if skip {
+		st.status.Status = stepSkipped
+		wfs.resolveChildren(st)
+		return
+	}
+
+	if wi, ok := st.job.(workflowInput); ok {
+		for _, t := range st.triggers {
+			wi.SetInput(t.parent.spec.Name, t.parent.payload)
+		}
+	}
+	wfs.run(st)
+}
+
+// run queues the job of st, the caller holds wfs.mux
+func (wfs *workflows) run(st *workflowStep) {
+	select {
+	case <-wfs.d.stopForward:
+		now := time.Now()
+		st.status.Status = outcomeFailed
+		st.status.Error = errDispatcherStopped.Error()
+		st.status.End = &now
+		wfs.resolveChildren(st)
+		return
+	default:
+	}
+
+	if err := st.job.InitWithJobChan(wfs.d.jobChannel()); err != nil {
+		now := time.Now()
+		st.status.Status = outcomeFailed
+		st.status.Error = err.Error()
+		st.status.End = &now
+		wfs.resolveChildren(st)
+		return
+	}
+
+	now := time.Now()
+	st.status.Status = stepRunning
+	st.status.JobID = st.job.ID()
+	st.status.Start = &now
+	wfs.byJob[st.job.ID()] = st
+	wfs.d.enqueue(st.job)
+}
+
+// checkDone records wf as finished once all of its steps are,
+// dropping the oldest finished workflows, the caller holds wfs.mux
+func (wfs *workflows) checkDone(wf *workflowRun) {
+	if wf.resp.Finished != nil {
+		return
+	}
+
+	status := outcomeSucceeded
+	for _, st := range wf.steps {
+		if !st.finished() {
+			return
+		}
+		switch {
+		case st.status.Status == outcomeFailed:
+			status = outcomeFailed
+		case st.status.Status == outcomeCancelled && status == outcomeSucceeded:
+			status = outcomeCancelled
+		}
+	}
+
+	now := time.Now()
+	wf.resp.Status = status
+	wf.resp.Finished = &now
+	for _, st := range wf.steps {
+		st.payload = nil
+	}
+
+	switch status {
+	case outcomeFailed:
+		wfs.d.MetricInc(dispatcherWorkflowsFailed)
+	case outcomeCancelled:
+		wfs.d.MetricInc(dispatcherWorkflowsCancelled)
+	default:
+		wfs.d.MetricInc(dispatcherWorkflowsSucceeded)
+	}
+
+	wfs.done = append(wfs.done, wf.resp.ID)
+	for len(wfs.done) > WorkflowHistorySize {
+		delete(wfs.runs, wfs.done[0])
+		wfs.done = wfs.done[1:]
+	}
+}
+
+// response returns the state of wf, the caller holds wfs.mux
+func (wf *workflowRun) response() workflowResponse {
+	resp := wf.resp
+	resp.Steps = make([]workflowStepStatus, 0, len(wf.steps))
+	for _, st := range wf.steps {
+		resp.Steps = append(resp.Steps, st.status)
+	}
+	return resp
+}
+
+// CreateWorkflow creates the workflow in jsonBlob, a workflowSpec,
+// and queues its first steps
+func (d *dispatcher) CreateWorkflow(jsonBlob []byte) (httpStatusCode int, jsonb []byte, err error) {
+	var spec workflowSpec
+	if e := json.Unmarshal(jsonBlob, &spec); e != nil {
+		msg := fmt.Sprintf("{\"error\": \"json.Unmarshal failed\", \"Error\": \"%v\"}", e.Error())
+		return http.StatusBadRequest, []byte(msg), e
+	}
+
+	wf, e := newWorkflowRun(spec)
+	if e != nil {
+		msg := fmt.Sprintf("{\"error\": \"invalid workflow\", \"Error\": \"%v\"}", e.Error())
+		return http.StatusBadRequest, []byte(msg), e
+	}
+
+	select {
+	case <-d.stopForward:
+		msg := fmt.Sprintf("{\"error\": \"dispatcher is shut down\"}")
+		return http.StatusServiceUnavailable, []byte(msg), errDispatcherStopped
+	default:
+	}
+
+	d.workflows.start(wf)
+	log.Printf("Workflow %v started with %d steps\n", wf.resp.ID, len(wf.steps))
+
+	d.workflows.mux.Lock()
+	resp := wf.response()
+	d.workflows.mux.Unlock()
+	return workflowJSON(http.StatusCreated, resp)
+}
+
+// ListWorkflows returns running and recently finished workflows
+// oldest first
+func (d *dispatcher) ListWorkflows() (httpStatusCode int, jsonb []byte, err error) {
+	d.workflows.mux.Lock()
+	list := make([]workflowResponse, 0, len(d.workflows.runs))
+	for _, wf := range d.workflows.runs {
+		list = append(list, wf.response())
+	}
+	d.workflows.mux.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return workflowJSON(http.StatusOK, list)
+}
+
+// GetWorkflow returns the workflow with id
+func (d *dispatcher) GetWorkflow(id string) (httpStatusCode int, jsonb []byte, err error) {
+	d.workflows.mux.Lock()
+	wf, ok := d.workflows.runs[id]
+	var resp workflowResponse
+	if ok {
+		resp = wf.response()
+	}
+	d.workflows.mux.Unlock()
+
+	if !ok {
+		msg := fmt.Sprintf("{\"error\": \"Not found\", \"UUID\": %v}", id)
+		return http.StatusNotFound, []byte(msg), errWorkflowNotFound
+	}
+	return workflowJSON(http.StatusOK, resp)
+}
+
+// workflowJSON marshals v as the response body
+func workflowJSON(status int, v interface{}) (httpStatusCode int, jsonb []byte, err error) {
+	jb, e := json.Marshal(v)
+	if e != nil {
+		msg := fmt.Sprintf("{\"error\": \"json.Marshal failed\", \"Error\": \"%v\"}", e.Error())
+		return http.StatusInternalServerError, []byte(msg), e
+	}
+	return status, jb, nil
+}